@@ -0,0 +1,89 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/piot/ibdf-go/src/ibdf"
+	"github.com/piot/log-go/src/clog"
+)
+
+func options() (string, string) {
+	var pcapngFilename string
+	flag.StringVar(&pcapngFilename, "pcapng", "", "pcapng file to export to, that can be opened in Wireshark")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		return "", pcapngFilename
+	}
+	return flag.Arg(0), pcapngFilename
+}
+
+func run(filename string, pcapngFilename string) error {
+	inFile, openErr := ibdf.NewInPacketFile(filename)
+	if openErr != nil {
+		return openErr
+	}
+	defer inFile.Close()
+
+	target, createErr := os.Create(path.Clean(pcapngFilename))
+	if createErr != nil {
+		return createErr
+	}
+	writer := bufio.NewWriter(target)
+	exportErr := ibdf.ExportPcapng(inFile, writer)
+	if exportErr == nil {
+		exportErr = writer.Flush()
+	}
+	closeErr := target.Close()
+	if exportErr != nil {
+		return exportErr
+	}
+
+	return closeErr
+}
+
+func main() {
+	log := clog.DefaultLog()
+	log.Info("ibdf export")
+	filename, pcapngFilename := options()
+	if filename == "" || pcapngFilename == "" {
+		fmt.Fprintln(os.Stderr, "usage: ibdf-export --pcapng <export.pcapng> <capture.ibdf>")
+		os.Exit(2)
+	}
+	err := run(filename, pcapngFilename)
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+
+	log.Info("Done!")
+}
@@ -0,0 +1,284 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/piot/ibdf-go/src/ibdf"
+	"github.com/piot/log-go/src/clog"
+)
+
+type options struct {
+	listenAddress string
+	serverAddress string
+	prefix        string
+	filePerClient bool
+}
+
+func parseOptions() options {
+	var o options
+	flag.StringVar(&o.listenAddress, "listen", ":32000", "UDP address the clients send to")
+	flag.StringVar(&o.serverAddress, "server", "127.0.0.1:32001", "UDP address of the server")
+	flag.StringVar(&o.prefix, "out", "capture", "filename prefix of the captures")
+	flag.BoolVar(&o.filePerClient, "file-per-client", false, "one file per client address instead of one file with a connection id per client")
+	flag.Parse()
+	return o
+}
+
+// client is a client address that is proxied through its own socket, so the responses from the server can be
+// sent back to the right client.
+type client struct {
+	address      *net.UDPAddr
+	upstream     *net.UDPConn
+	connectionID ibdf.ConnectionID
+	file         *ibdf.OutPacketFile
+}
+
+// proxy records from the point of view of the server: datagrams from clients are incoming and responses are outgoing.
+type proxy struct {
+	options    options
+	listener   *net.UDPConn
+	serverAddr *net.UDPAddr
+	log        *clog.Log
+	start      time.Time
+
+	lock     sync.Mutex
+	clients  map[string]*client
+	file     *ibdf.OutPacketFile
+	nextID   ibdf.ConnectionID
+	closing  bool
+	recorded int
+}
+
+func (p *proxy) monotonicTimeMs() int64 {
+	return time.Since(p.start).Milliseconds()
+}
+
+func captureFilename(prefix string, address *net.UDPAddr) string {
+	name := strings.NewReplacer(":", "_", ".", "_", "[", "", "]", "").Replace(address.String())
+	return fmt.Sprintf("%s_%s.ibdf", prefix, name)
+}
+
+func (p *proxy) record(c *client, direction ibdf.PacketDirection, payload []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closing {
+		return nil
+	}
+	p.recorded++
+	monotonicTimeMs := p.monotonicTimeMs()
+	if c.file != nil {
+		if direction == ibdf.CmdIncomingPacket {
+			return c.file.DebugIncomingPacket(payload, monotonicTimeMs)
+		}
+		return c.file.DebugOutgoingPacket(payload, monotonicTimeMs)
+	}
+	if direction == ibdf.CmdIncomingPacket {
+		return p.file.DebugIncomingPacketOnConnection(c.connectionID, payload, monotonicTimeMs)
+	}
+	return p.file.DebugOutgoingPacketOnConnection(c.connectionID, payload, monotonicTimeMs)
+}
+
+func (p *proxy) findOrAddClient(address *net.UDPAddr) (*client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := address.String()
+	existing, found := p.clients[key]
+	if found {
+		return existing, nil
+	}
+
+	upstream, dialErr := net.DialUDP("udp", nil, p.serverAddr)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	c := &client{address: address, upstream: upstream, connectionID: p.nextID}
+	p.nextID++
+	if p.options.filePerClient {
+		file, createErr := ibdf.NewOutPacketFile(captureFilename(p.options.prefix, address), ibdf.Header{}, nil)
+		if createErr != nil {
+			upstream.Close()
+			return nil, createErr
+		}
+		c.file = file
+	} else {
+		openedErr := p.file.DebugConnectionOpened(c.connectionID, p.monotonicTimeMs())
+		if openedErr != nil {
+			upstream.Close()
+			return nil, openedErr
+		}
+	}
+	p.clients[key] = c
+	p.log.Info(fmt.Sprintf("new client %v (connection %v)", address, c.connectionID))
+	go p.forwardResponses(c)
+
+	return c, nil
+}
+
+func (p *proxy) forwardResponses(c *client) {
+	buf := make([]byte, 64*1024)
+	for {
+		octetCount, readErr := c.upstream.Read(buf)
+		if readErr != nil {
+			return
+		}
+		_, writeErr := p.listener.WriteToUDP(buf[:octetCount], c.address)
+		if writeErr != nil {
+			p.log.Err(writeErr)
+			continue
+		}
+		recordErr := p.record(c, ibdf.CmdOutgoingPacket, buf[:octetCount])
+		if recordErr != nil {
+			p.log.Err(recordErr)
+		}
+	}
+}
+
+func (p *proxy) run() error {
+	buf := make([]byte, 64*1024)
+	for {
+		octetCount, address, readErr := p.listener.ReadFromUDP(buf)
+		if readErr != nil {
+			p.lock.Lock()
+			closing := p.closing
+			p.lock.Unlock()
+			if closing {
+				return nil
+			}
+			return readErr
+		}
+		c, clientErr := p.findOrAddClient(address)
+		if clientErr != nil {
+			return clientErr
+		}
+		_, writeErr := c.upstream.Write(buf[:octetCount])
+		if writeErr != nil {
+			p.log.Err(writeErr)
+			continue
+		}
+		recordErr := p.record(c, ibdf.CmdIncomingPacket, buf[:octetCount])
+		if recordErr != nil {
+			return recordErr
+		}
+	}
+}
+
+func (p *proxy) close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closing {
+		return nil
+	}
+	p.closing = true
+	p.listener.Close()
+	var firstErr error
+	for _, c := range p.clients {
+		c.upstream.Close()
+		var closeErr error
+		if c.file != nil {
+			closeErr = c.file.Close()
+		} else {
+			closeErr = p.file.DebugConnectionClosed(c.connectionID, p.monotonicTimeMs())
+		}
+		if firstErr == nil {
+			firstErr = closeErr
+		}
+	}
+	if p.file != nil {
+		closeErr := p.file.Close()
+		if firstErr == nil {
+			firstErr = closeErr
+		}
+	}
+	return firstErr
+}
+
+func run(o options, log *clog.Log) error {
+	serverAddr, resolveErr := net.ResolveUDPAddr("udp", o.serverAddress)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	listenAddr, listenResolveErr := net.ResolveUDPAddr("udp", o.listenAddress)
+	if listenResolveErr != nil {
+		return listenResolveErr
+	}
+	listener, listenErr := net.ListenUDP("udp", listenAddr)
+	if listenErr != nil {
+		return listenErr
+	}
+
+	p := &proxy{options: o, listener: listener, serverAddr: serverAddr, log: log, start: time.Now(),
+		clients: make(map[string]*client), nextID: 1}
+	if !o.filePerClient {
+		file, createErr := ibdf.NewOutPacketFile(o.prefix+".ibdf", ibdf.Header{}, nil)
+		if createErr != nil {
+			listener.Close()
+			return createErr
+		}
+		p.file = file
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	closeDone := make(chan error, 1)
+	go func() {
+		<-interrupt
+		closeDone <- p.close()
+	}()
+
+	log.Info(fmt.Sprintf("proxying %v to %v, press ctrl-c to stop", listener.LocalAddr(), serverAddr))
+	runErr := p.run()
+	if runErr != nil {
+		p.close()
+		return runErr
+	}
+	closeErr := <-closeDone
+	fmt.Printf("recorded %v datagrams from %v clients\n", p.recorded, len(p.clients))
+
+	return closeErr
+}
+
+func main() {
+	log := clog.DefaultLog()
+	log.Info("ibdf record")
+	o := parseOptions()
+	err := run(o, log)
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+
+	log.Info("Done!")
+}
@@ -0,0 +1,94 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/piot/ibdf-go/src/ibdf"
+	"github.com/piot/log-go/src/clog"
+)
+
+func options() (string, string) {
+	flag.Parse()
+	if flag.NArg() < 2 {
+		return "", ""
+	}
+	return flag.Arg(0), flag.Arg(1)
+}
+
+func run(sourceFilename string, targetFilename string) error {
+	source, sourceErr := os.Open(path.Clean(sourceFilename))
+	if sourceErr != nil {
+		return sourceErr
+	}
+	defer source.Close()
+
+	sourceStat, sourceStatErr := source.Stat()
+	if sourceStatErr != nil {
+		return sourceStatErr
+	}
+	targetStat, targetStatErr := os.Stat(path.Clean(targetFilename))
+	if targetStatErr == nil && os.SameFile(sourceStat, targetStat) {
+		return fmt.Errorf("repaired file must not be the same as the truncated file %v", sourceFilename)
+	}
+
+	target, targetErr := os.Create(path.Clean(targetFilename))
+	if targetErr != nil {
+		return targetErr
+	}
+	report, repairErr := ibdf.RepairPacketFile(source, target)
+	target.Close()
+	if repairErr != nil {
+		os.Remove(targetFilename)
+		return repairErr
+	}
+
+	fmt.Printf("recovered %v chunks (%v octets), discarded %v octets\n", report.ChunkCount, report.RecoveredOctetCount,
+		report.DiscardedOctetCount)
+	return nil
+}
+
+func main() {
+	log := clog.DefaultLog()
+	log.Info("ibdf repair")
+	sourceFilename, targetFilename := options()
+	if sourceFilename == "" {
+		fmt.Fprintln(os.Stderr, "usage: ibdf-repair <truncated.ibdf> <repaired.ibdf>")
+		os.Exit(2)
+	}
+	err := run(sourceFilename, targetFilename)
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+
+	log.Info("Done!")
+}
@@ -0,0 +1,253 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/piot/ibdf-go/src/ibdf"
+	"github.com/piot/log-go/src/clog"
+)
+
+type options struct {
+	filename       string
+	address        string
+	direction      ibdf.PacketDirection
+	fast           bool
+	speed          float64
+	recordFilename string
+	linger         time.Duration
+}
+
+func parseOptions() (options, error) {
+	var o options
+	var direction string
+	flag.StringVar(&o.address, "address", "127.0.0.1:32001", "UDP address to send the packets to")
+	flag.StringVar(&direction, "direction", "in", "which packets to send, 'in' or 'out'. ibdf-record captures client packets as 'in'")
+	flag.BoolVar(&o.fast, "fast", false, "send as fast as possible instead of with the original timing")
+	flag.Float64Var(&o.speed, "speed", 1, "speed multiplier for the original timing")
+	flag.StringVar(&o.recordFilename, "record", "", "record sent packets and responses to this ibdf file")
+	flag.DurationVar(&o.linger, "linger", time.Second, "how long to wait for responses after the last packet")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		return o, fmt.Errorf("usage: ibdf-replay [options] <capture.ibdf>")
+	}
+	o.filename = flag.Arg(0)
+	switch direction {
+	case "out":
+		o.direction = ibdf.CmdOutgoingPacket
+	case "in":
+		o.direction = ibdf.CmdIncomingPacket
+	default:
+		return o, fmt.Errorf("unknown direction '%v'", direction)
+	}
+	return o, nil
+}
+
+type recorder struct {
+	lock  sync.Mutex
+	file  *ibdf.OutPacketFile
+	start time.Time
+}
+
+func (r *recorder) record(direction ibdf.PacketDirection, payload []byte) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	monotonicTimeMs := time.Since(r.start).Milliseconds()
+	if direction == ibdf.CmdOutgoingPacket {
+		return r.file.DebugOutgoingPacket(payload, monotonicTimeMs)
+	}
+	return r.file.DebugIncomingPacket(payload, monotonicTimeMs)
+}
+
+// copyFirstState writes the first state of the replayed capture, so the recording can be opened as a capture of its own.
+func copyFirstState(inFile *ibdf.InPacketFile, outFile *ibdf.OutPacketFile) error {
+	for _, info := range inFile.AllHeaders() {
+		if info.PacketType() != ibdf.PacketTypeState {
+			continue
+		}
+		_, _, state, readErr := inFile.ReadStatePacket(info.PacketIndex())
+		if readErr != nil {
+			return readErr
+		}
+		return outFile.DebugState(state, 0)
+	}
+	return nil
+}
+
+// responseDirection returns the direction the responses to the sent packets had in the capture.
+func responseDirection(sentDirection ibdf.PacketDirection) ibdf.PacketDirection {
+	if sentDirection == ibdf.CmdIncomingPacket {
+		return ibdf.CmdOutgoingPacket
+	}
+	return ibdf.CmdIncomingPacket
+}
+
+func receiveResponses(conn *net.UDPConn, rec *recorder, direction ibdf.PacketDirection, log *clog.Log) {
+	buf := make([]byte, 64*1024)
+	for {
+		octetCount, readErr := conn.Read(buf)
+		if readErr != nil {
+			return
+		}
+		recordErr := rec.record(direction, buf[:octetCount])
+		if recordErr != nil {
+			log.Err(recordErr)
+			return
+		}
+	}
+}
+
+func send(conn *net.UDPConn, rec *recorder, direction ibdf.PacketDirection, payload []byte) error {
+	_, writeErr := conn.Write(payload)
+	if writeErr != nil {
+		return writeErr
+	}
+	return rec.record(direction, payload)
+}
+
+func replay(sequence *ibdf.InPacketFileSequence, o options, conn *net.UDPConn, rec *recorder) (int, error) {
+	sentCount := 0
+	if !o.fast {
+		player := ibdf.NewPlayer(sequence, ibdf.SystemClock{})
+		speedErr := player.SetSpeed(o.speed)
+		if speedErr != nil {
+			return 0, speedErr
+		}
+		playErr := player.Play(func(record ibdf.Record) error {
+			if record.PacketDirection() != o.direction {
+				return nil
+			}
+			sentCount++
+			return send(conn, rec, o.direction, record.Payload())
+		})
+		return sentCount, playErr
+	}
+
+	for {
+		direction, _, payload, readErr := sequence.ReadNextPacket()
+		if readErr == io.EOF {
+			return sentCount, nil
+		}
+		if readErr != nil {
+			return sentCount, readErr
+		}
+		if direction != o.direction {
+			continue
+		}
+		sentCount++
+		sendErr := send(conn, rec, o.direction, payload)
+		if sendErr != nil {
+			return sentCount, sendErr
+		}
+	}
+}
+
+func run(o options, log *clog.Log) error {
+	inFile, openErr := ibdf.NewInPacketFile(o.filename)
+	if openErr != nil {
+		return openErr
+	}
+	sequence, sequenceErr := ibdf.NewInPacketFileSequenceFromInFile(inFile)
+	if sequenceErr != nil {
+		inFile.Close()
+		return sequenceErr
+	}
+	defer sequence.Close()
+
+	remoteAddr, resolveErr := net.ResolveUDPAddr("udp", o.address)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	conn, dialErr := net.DialUDP("udp", nil, remoteAddr)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer conn.Close()
+
+	var rec *recorder
+	receiveDone := make(chan struct{})
+	if o.recordFilename != "" {
+		outFile, createErr := ibdf.NewOutPacketFile(o.recordFilename, inFile.Header(), inFile.SchemaPayload())
+		if createErr != nil {
+			return createErr
+		}
+		stateErr := copyFirstState(inFile, outFile)
+		if stateErr != nil {
+			outFile.Close()
+			return stateErr
+		}
+		rec = &recorder{file: outFile, start: time.Now()}
+		go func() {
+			receiveResponses(conn, rec, responseDirection(o.direction), log)
+			close(receiveDone)
+		}()
+	}
+
+	sentCount, replayErr := replay(sequence, o, conn, rec)
+	fmt.Printf("sent %v packets to %v\n", sentCount, remoteAddr)
+
+	if rec != nil {
+		time.Sleep(o.linger)
+		// The connection is closed first, so no response is recorded after the file is closed.
+		conn.Close()
+		<-receiveDone
+		closeErr := rec.file.Close()
+		if replayErr == nil {
+			replayErr = closeErr
+		}
+	}
+
+	return replayErr
+}
+
+func main() {
+	log := clog.DefaultLog()
+	log.Info("ibdf replay")
+	o, optionsErr := parseOptions()
+	if optionsErr != nil {
+		fmt.Fprintln(os.Stderr, optionsErr)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	err := run(o, log)
+	if err != nil {
+		log.Err(err)
+		os.Exit(1)
+	}
+
+	log.Info("Done!")
+}
@@ -34,22 +34,24 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/piot/ibdf-go/src/ibdf"
 	"github.com/piot/log-go/src/clog"
 )
 
-func options() string {
+func options() (string, bool) {
 	//var piffFile string
 	//	flag.StringVar(&piffFile, "filename", "", "file to view")
+	follow := flag.Bool("follow", false, "wait for more chunks when reaching the end, like tail -f")
 	flag.Parse()
 	count := flag.NArg()
 	if count < 1 {
-		return ""
+		return "", *follow
 	}
 	ibdfFilename := flag.Arg(0)
-	return ibdfFilename
+	return ibdfFilename, *follow
 }
 
 func cmdToString(direction ibdf.PacketDirection) string {
@@ -83,12 +85,19 @@ func octetsToString(payload []byte) string {
 	return strings.TrimSpace(hex.Dump(payload)) + "\n" + base64String + "\n"
 }
 
-func run(filename string, log *clog.Log) error {
+func openStream(reader io.Reader, follow bool) (*ibdf.InStream, error) {
+	if follow {
+		return ibdf.NewInPacketStreamFollow(reader, 250*time.Millisecond)
+	}
+	return ibdf.NewInPacketStream(reader)
+}
+
+func run(filename string, follow bool, log *clog.Log) error {
 	seekerToUse, seekerErr := openReadSeeker(filename)
 	if seekerErr != nil {
 		return seekerErr
 	}
-	inStream, err := ibdf.NewInPacketStream(seekerToUse)
+	inStream, err := openStream(seekerToUse, follow)
 	if err != nil {
 		_, isStateError := err.(*ibdf.MissingStateError)
 		if !isStateError {
@@ -96,31 +105,26 @@ func run(filename string, log *clog.Log) error {
 		}
 	}
 
-	header, headerErr := inStream.ReadNextFileHeader()
-	if headerErr != nil {
-		return headerErr
-	}
-	color.HiMagenta(header.String())
-
-	fmt.Printf("schema:\n")
-	if !inStream.IsNextSchema() {
-		return fmt.Errorf("Must start with schema")
-	}
-	schemaString, schemaErr := inStream.ReadNextSchemaTextPacket()
-	if schemaErr != nil {
-		return schemaErr
-	}
-	color.HiGreen("%v\n", schemaString)
-
 	outgoingIndex := 0
 	incomingIndex := 0
 
-	for !inStream.IsEOF() {
-		if inStream.IsNextPacket() {
-			chunkIndex, cmd, time, payload, readErr := inStream.ReadNextPacket()
-			if readErr == io.EOF {
-				break
-			}
+	for {
+		record, readErr := inStream.Next()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+		switch record.Type() {
+		case ibdf.RecordTypeFileHeader:
+			color.HiMagenta(record.FileHeader().String())
+		case ibdf.RecordTypeSchema:
+			fmt.Printf("schema:\n")
+			color.HiGreen("%v\n", string(record.Payload()))
+		case ibdf.RecordTypePacket:
+			cmd := record.PacketDirection()
+			payload := record.Payload()
 			cmdString := cmdToString(cmd)
 			headerColor := color.New(color.FgMagenta)
 			payloadColor := color.New(color.FgHiMagenta)
@@ -133,7 +137,11 @@ func run(filename string, log *clog.Log) error {
 				filteredIndexToShow = incomingIndex
 			}
 
-			headerColor.Printf("#%04d (filtered #%04d) %s time:%v (%v octets)\n", chunkIndex, filteredIndexToShow, cmdString, time, len(payload))
+			connectionString := ""
+			if record.ConnectionID() != ibdf.NoConnectionID {
+				connectionString = fmt.Sprintf("conn:%v ", record.ConnectionID())
+			}
+			headerColor.Printf("#%04d (filtered #%04d) %s %stime:%v (%v octets)\n", record.ChunkIndex(), filteredIndexToShow, cmdString, connectionString, record.Timestamp(), len(payload))
 			payloadColor.Println(octetsToString(payload))
 
 			if cmd == ibdf.CmdOutgoingPacket {
@@ -141,16 +149,24 @@ func run(filename string, log *clog.Log) error {
 			} else if cmd == ibdf.CmdIncomingPacket {
 				incomingIndex++
 			}
-		} else if inStream.IsNextState() {
-			chunkIndex, time, statePayload, readErr := inStream.ReadNextStatePacket()
-			if readErr == io.EOF {
-				break
-			}
-			color.Cyan("#%04d * (state) time:%v (%v octets)", chunkIndex, time, len(statePayload))
+		case ibdf.RecordTypeState:
+			statePayload := record.Payload()
+			color.Cyan("#%04d * (state) time:%v (%v octets)", record.ChunkIndex(), record.Timestamp(), len(statePayload))
 			color.HiCyan(octetsToString(statePayload))
 			fmt.Println("")
-		} else {
-			color.Red("Unknown packet!")
+		case ibdf.RecordTypeConnectionEvent:
+			color.Yellow("#%04d conn:%v %v time:%v", record.ChunkIndex(), record.ConnectionID(), record.ConnectionEvent(), record.Timestamp())
+		case ibdf.RecordTypeAnnotation:
+			color.HiYellow("#%04d ## %v time:%v (%v octets)", record.ChunkIndex(), record.Label(), record.Timestamp(), len(record.Payload()))
+			if len(record.Payload()) > 0 {
+				color.Yellow(octetsToString(record.Payload()))
+			}
+		case ibdf.RecordTypeClockSync:
+			color.Yellow("#%04d clock time:%v = %v", record.ChunkIndex(), record.Timestamp(), record.WallClock().Format(time.RFC3339Nano))
+		case ibdf.RecordTypeIndex:
+			color.Yellow("#%04d index (%v octets)", record.ChunkIndex(), len(record.Payload()))
+		default:
+			color.Red("#%04d Unknown chunk '%v'!", record.ChunkIndex(), record.TypeID())
 			fmt.Println("")
 		}
 	}
@@ -161,8 +177,8 @@ func run(filename string, log *clog.Log) error {
 func main() {
 	log := clog.DefaultLog()
 	log.Info("ibdf viewer")
-	filename := options()
-	err := run(filename, log)
+	filename, follow := options()
+	err := run(filename, follow, log)
 	if err != nil {
 		log.Err(err)
 		os.Exit(1)
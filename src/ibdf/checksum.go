@@ -0,0 +1,71 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+const checksumOctetCount = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func isChecksummedTypeID(typeID string) bool {
+	switch uncompressedTypeID(typeID) {
+	case "pkt1", "pkt2", "sta1", "std1":
+		return true
+	default:
+		return false
+	}
+}
+
+func appendChecksum(payload []byte) []byte {
+	var checksumOctets [checksumOctetCount]byte
+	binary.BigEndian.PutUint32(checksumOctets[:], crc32.Checksum(payload, castagnoliTable))
+	return append(payload, checksumOctets[:]...)
+}
+
+// stripChecksum verifies and removes the checksum at the end of packet and state chunks.
+func stripChecksum(checksums bool, header piff.InHeader, payload []byte) ([]byte, error) {
+	if !checksums || !isChecksummedTypeID(header.TypeIDString()) {
+		return payload, nil
+	}
+	if len(payload) < checksumOctetCount {
+		return nil, &CorruptChunkError{ChunkIndex: int(header.ChunkIndex()), TypeID: header.TypeIDString(),
+			ExpectedOctetCount: checksumOctetCount, ActualOctetCount: len(payload)}
+	}
+	contentOctetCount := len(payload) - checksumOctetCount
+	expected := binary.BigEndian.Uint32(payload[contentOctetCount:])
+	actual := crc32.Checksum(payload[:contentOctetCount], castagnoliTable)
+	if expected != actual {
+		return nil, &ChecksumError{ChunkIndex: int(header.ChunkIndex()), Expected: expected, Actual: actual}
+	}
+	return payload[:contentOctetCount], nil
+}
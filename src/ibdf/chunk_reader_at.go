@@ -0,0 +1,60 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+// chunkReaderAt reads chunk payloads with ReadAt, from the positions of the already scanned piff headers.
+// It has no position of its own, so chunks can be read from several goroutines at the same time.
+type chunkReaderAt struct {
+	readerAt io.ReaderAt
+	headers  []*piff.SeekHeader
+	offsets  []int64
+}
+
+func newChunkReaderAt(readerAt io.ReaderAt, headers []*piff.SeekHeader) *chunkReaderAt {
+	return &chunkReaderAt{readerAt: readerAt, headers: headers, offsets: chunkOffsets(headers)}
+}
+
+func (r *chunkReaderAt) findChunk(chunkIndex int) (piff.InHeader, []byte, error) {
+	if chunkIndex < 0 || chunkIndex >= len(r.headers) {
+		var header piff.InHeader
+		return header, nil, fmt.Errorf("chunk %v is not in the file", chunkIndex)
+	}
+	header := r.headers[chunkIndex].Header()
+	payload := make([]byte, header.OctetCount())
+	octetsRead, readErr := r.readerAt.ReadAt(payload, r.offsets[chunkIndex]+piffChunkHeaderOctetCount)
+	if readErr != nil && !(readErr == io.EOF && octetsRead == len(payload)) {
+		return header, nil, readErr
+	}
+	return header, payload, nil
+}
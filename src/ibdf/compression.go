@@ -0,0 +1,153 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+// Compression is used for the octets of packet and state chunks. The chunk headers (direction, timestamp)
+// are never compressed, so files can be scanned without decompressing anything.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionDeflate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("unknown compression %d", uint8(c))
+	}
+}
+
+// maxDecompressedOctetCount protects against chunks that decompress to something far larger than any packet or state.
+const maxDecompressedOctetCount = 64 * 1024 * 1024
+
+// Compressed packet and state chunks have their own type IDs, so readers that don't know about compression fail
+// instead of returning the compressed octets.
+var compressedTypeIDs = map[string]string{"pkt1": "pkz1", "pkt2": "pkz2", "sta1": "stz1", "std1": "sdz1"}
+
+var uncompressedTypeIDs = map[string]string{"pkz1": "pkt1", "pkz2": "pkt2", "stz1": "sta1", "sdz1": "std1"}
+
+// uncompressedTypeID returns the type ID of the chunk as if it wasn't compressed.
+func uncompressedTypeID(typeID string) string {
+	uncompressed, isCompressed := uncompressedTypeIDs[typeID]
+	if !isCompressed {
+		return typeID
+	}
+	return uncompressed
+}
+
+func isCompressedTypeID(typeID string) bool {
+	_, isCompressed := uncompressedTypeIDs[typeID]
+	return isCompressed
+}
+
+func checkCompression(compression Compression) error {
+	switch compression {
+	case CompressionNone, CompressionDeflate:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression %d", uint8(compression))
+	}
+}
+
+type compressor struct {
+	compression Compression
+	buffer      bytes.Buffer
+	writer      *flate.Writer
+}
+
+func newCompressor(compression Compression) (*compressor, error) {
+	checkErr := checkCompression(compression)
+	if checkErr != nil {
+		return nil, checkErr
+	}
+	return &compressor{compression: compression}, nil
+}
+
+func (c *compressor) typeID(typeID string) string {
+	if c.compression == CompressionNone {
+		return typeID
+	}
+	return compressedTypeIDs[typeID]
+}
+
+func (c *compressor) compress(octets []byte) ([]byte, error) {
+	if c.compression == CompressionNone {
+		return octets, nil
+	}
+	c.buffer.Reset()
+	if c.writer == nil {
+		writer, writerErr := flate.NewWriter(&c.buffer, flate.DefaultCompression)
+		if writerErr != nil {
+			return nil, writerErr
+		}
+		c.writer = writer
+	} else {
+		c.writer.Reset(&c.buffer)
+	}
+	_, writeErr := c.writer.Write(octets)
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	closeErr := c.writer.Close()
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	compressed := make([]byte, c.buffer.Len())
+	copy(compressed, c.buffer.Bytes())
+	return compressed, nil
+}
+
+func decompressOctets(header piff.InHeader, octets []byte) ([]byte, error) {
+	if !isCompressedTypeID(header.TypeIDString()) {
+		return octets, nil
+	}
+	reader := flate.NewReader(bytes.NewReader(octets))
+	defer reader.Close()
+	decompressed, readErr := ioutil.ReadAll(io.LimitReader(reader, maxDecompressedOctetCount+1))
+	if readErr != nil {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("decompress: %v", readErr))
+	}
+	if len(decompressed) > maxDecompressedOctetCount {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("decompresses to more than %v octets", maxDecompressedOctetCount))
+	}
+	return decompressed, nil
+}
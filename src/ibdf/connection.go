@@ -0,0 +1,53 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import "fmt"
+
+// ConnectionID identifies a connection (peer) in captures that record several connections in the same file.
+// Packets recorded without a connection have NoConnectionID, so connection ids start at one.
+type ConnectionID uint32
+
+const NoConnectionID ConnectionID = 0
+
+type ConnectionEvent uint8
+
+const (
+	ConnectionOpened ConnectionEvent = iota + 1
+	ConnectionClosed
+)
+
+func (e ConnectionEvent) String() string {
+	switch e {
+	case ConnectionOpened:
+		return "opened"
+	case ConnectionClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown connection event %d", uint8(e))
+	}
+}
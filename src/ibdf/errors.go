@@ -26,9 +26,48 @@ SOFTWARE.
 
 package ibdf
 
+import "fmt"
+
 type MissingStateError struct {
 }
 
 func (e *MissingStateError) Error() string {
 	return "missing state in packet file"
 }
+
+type ChecksumError struct {
+	ChunkIndex int
+	Expected   uint32
+	Actual     uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch in chunk %v: expected %08x, but was %08x", e.ChunkIndex, e.Expected, e.Actual)
+}
+
+// CorruptChunkError is returned when a chunk can not be deserialized, e.g. when it is truncated.
+type CorruptChunkError struct {
+	ChunkIndex         int
+	TypeID             string
+	ExpectedOctetCount int
+	ActualOctetCount   int
+	Reason             string
+}
+
+func (e *CorruptChunkError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("corrupt chunk %v (%v): %v", e.ChunkIndex, e.TypeID, e.Reason)
+	}
+	return fmt.Sprintf("corrupt chunk %v (%v): expected at least %v octets, but got %v", e.ChunkIndex, e.TypeID,
+		e.ExpectedOctetCount, e.ActualOctetCount)
+}
+
+type UnsupportedSeekError struct {
+	Position int64
+	Offset   int64
+	Whence   int
+}
+
+func (e *UnsupportedSeekError) Error() string {
+	return fmt.Sprintf("can only seek forward from position %v (offset %v, whence %v)", e.Position, e.Offset, e.Whence)
+}
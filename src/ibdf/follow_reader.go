@@ -0,0 +1,69 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// FollowReader waits for more octets when it reaches the end of the reader, like `tail -f`, until Stop is called.
+type FollowReader struct {
+	reader       io.Reader
+	pollInterval time.Duration
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+func NewFollowReader(reader io.Reader, pollInterval time.Duration) *FollowReader {
+	return &FollowReader{reader: reader, pollInterval: pollInterval, stop: make(chan struct{})}
+}
+
+func (f *FollowReader) Read(p []byte) (int, error) {
+	for {
+		octetsRead, readErr := f.reader.Read(p)
+		if octetsRead > 0 {
+			return octetsRead, nil
+		}
+		if readErr != nil && readErr != io.EOF {
+			return 0, readErr
+		}
+		select {
+		case <-f.stop:
+			return 0, io.EOF
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+// Stop makes Read return io.EOF when the end of the reader is reached, also for a Read that is currently waiting.
+func (f *FollowReader) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+}
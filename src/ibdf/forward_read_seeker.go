@@ -26,8 +26,13 @@ SOFTWARE.
 
 package ibdf
 
-import "io"
+import (
+	"io"
+	"io/ioutil"
+)
 
+// ForwardReadSeeker makes a reader usable where a seeker is needed, as long as it only seeks forward.
+// Forward seeks read and discard the octets that are skipped.
 type ForwardReadSeeker struct {
 	reader   io.Reader
 	position int64
@@ -38,28 +43,31 @@ func NewForwardReadSeeker(reader io.Reader) *ForwardReadSeeker {
 }
 
 func (f *ForwardReadSeeker) Seek(offset int64, whence int) (int64, error) {
-	requestedPosition := offset
+	var requestedPosition int64
 	switch whence {
-	case io.SeekStart: // means relative to the start of the file
-	// do nothing
-	case io.SeekCurrent: // means relative to the current offset
+	case io.SeekStart:
+		requestedPosition = offset
+	case io.SeekCurrent:
 		requestedPosition = f.position + offset
-	case io.SeekEnd: //means relative to the end
-		panic("not supported")
+	default:
+		return f.position, &UnsupportedSeekError{Position: f.position, Offset: offset, Whence: whence}
 	}
 
 	if requestedPosition < f.position {
-		panic("not supported")
+		return f.position, &UnsupportedSeekError{Position: f.position, Offset: offset, Whence: whence}
 	}
 
-	return 0, nil
+	skipped, skipErr := io.CopyN(ioutil.Discard, f.reader, requestedPosition-f.position)
+	f.position += skipped
+	if skipErr == io.EOF {
+		return f.position, io.ErrUnexpectedEOF
+	}
+
+	return f.position, skipErr
 }
 
 func (f *ForwardReadSeeker) Read(p []byte) (n int, err error) {
 	octetsRead, readErr := f.reader.Read(p)
-	if readErr != nil {
-		return 0, readErr
-	}
 	f.position += int64(octetsRead)
 	return octetsRead, readErr
 }
@@ -0,0 +1,77 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestForwardReadSeekerSkipsForward(t *testing.T) {
+	f := NewForwardReadSeeker(bytes.NewReader([]byte("0123456789")))
+	position, seekErr := f.Seek(3, io.SeekCurrent)
+	if seekErr != nil || position != 3 {
+		t.Fatalf("wrong seek %v %v", position, seekErr)
+	}
+	position, seekErr = f.Seek(5, io.SeekStart)
+	if seekErr != nil || position != 5 {
+		t.Fatalf("wrong seek %v %v", position, seekErr)
+	}
+	octets := make([]byte, 2)
+	_, readErr := io.ReadFull(f, octets)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if string(octets) != "56" {
+		t.Errorf("expected to read after the skipped octets, got %s", octets)
+	}
+	position, seekErr = f.Seek(0, io.SeekCurrent)
+	if seekErr != nil || position != 7 {
+		t.Errorf("wrong position %v %v", position, seekErr)
+	}
+	_, seekErr = f.Seek(20, io.SeekStart)
+	if seekErr != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF when skipping past the end, got %v", seekErr)
+	}
+}
+
+func TestForwardReadSeekerRejectsUnsupportedSeeks(t *testing.T) {
+	f := NewForwardReadSeeker(bytes.NewReader([]byte("0123456789")))
+	f.Seek(4, io.SeekStart)
+
+	var seekErr *UnsupportedSeekError
+	_, backwardsErr := f.Seek(2, io.SeekStart)
+	if !errors.As(backwardsErr, &seekErr) {
+		t.Errorf("expected backwards seek to fail, got %v", backwardsErr)
+	}
+	_, endErr := f.Seek(0, io.SeekEnd)
+	if !errors.As(endErr, &seekErr) {
+		t.Errorf("expected seek from end to fail, got %v", endErr)
+	}
+}
@@ -37,15 +37,31 @@ func (n NameAndVersion) String() string {
 	return fmt.Sprintf("[%v %v]", n.Name, n.Version)
 }
 
+func (n NameAndVersion) serializedOctetCount() int {
+	return 1 + len(n.Name) + 1 + len(n.Version)
+}
+
 type Header struct {
 	CompanyName   string
 	Application   NameAndVersion
 	NetworkEngine NameAndVersion
 	Protocol      NameAndVersion
 	Schema        NameAndVersion
+	Compression   Compression
+	// Checksums adds a CRC32C checksum to the end of every packet and state chunk
+	Checksums bool
 }
 
+const headerFlagChecksums = 0x01
+
 func (h Header) String() string {
-	return fmt.Sprintf("Company: %v\nApplication: %v\nSchema: %v\nNetworkEngine: %v\nProtocol: %v", h.CompanyName,
-		h.Application, h.Schema, h.NetworkEngine, h.Protocol)
+	return fmt.Sprintf("Company: %v\nApplication: %v\nSchema: %v\nNetworkEngine: %v\nProtocol: %v\nCompression: %v\nChecksums: %v", h.CompanyName,
+		h.Application, h.Schema, h.NetworkEngine, h.Protocol, h.Compression, h.Checksums)
+}
+
+// serializedOctetCountWithoutOptionals is the size of the header as written by versions that only had names and versions.
+// Anything after that is optional fields.
+func (h Header) serializedOctetCountWithoutOptionals() int {
+	return 1 + len(h.CompanyName) + h.Application.serializedOctetCount() + h.Schema.serializedOctetCount() +
+		h.NetworkEngine.serializedOctetCount() + h.Protocol.serializedOctetCount()
 }
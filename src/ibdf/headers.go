@@ -28,20 +28,232 @@ package ibdf
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/piot/brook-go/src/instream"
+	"github.com/piot/brook-go/src/outstream"
 	"github.com/piot/piff-go/src/piff"
 )
 
 const pktHeaderOctetCount = 1 + 8
 const pktHeaderStateOctetCount = 8
+const pktHeaderStateDeltaOctetCount = 8 + 4
+const annotationHeaderOctetCount = 8
+const clockSyncOctetCount = 8 + 8
+const pktConnectionHeaderOctetCount = 1 + 4 + 8
+const connectionEventOctetCount = 1 + 4 + 8
 
-func deserializeStateHeader(header piff.InHeader, payload []byte) (uint64, error) {
-	if header.TypeIDString() != "sta1" {
-		return 0, fmt.Errorf("wrong typeid %v", header)
+// piffChunkHeaderOctetCount is the type id and octet count that piff writes before every chunk payload.
+const piffChunkHeaderOctetCount = 4 + 4
+
+func newCorruptChunkError(header piff.InHeader, reason string) error {
+	return &CorruptChunkError{ChunkIndex: int(header.ChunkIndex()), TypeID: header.TypeIDString(), Reason: reason}
+}
+
+// checkChunk validates the type id and that the payload holds at least minimumOctetCount octets,
+// so the payload can be sliced safely.
+func checkChunk(header piff.InHeader, payload []byte, typeID string, minimumOctetCount int) error {
+	if uncompressedTypeID(header.TypeIDString()) != typeID {
+		return newCorruptChunkError(header, fmt.Sprintf("wrong typeid, expected %v", typeID))
+	}
+	if len(payload) < minimumOctetCount {
+		return &CorruptChunkError{ChunkIndex: int(header.ChunkIndex()), TypeID: header.TypeIDString(),
+			ExpectedOctetCount: minimumOctetCount, ActualOctetCount: len(payload)}
+	}
+	return nil
+}
+
+func serializePacket(cmd PacketDirection, monotonicTimeMs int64, octets []byte) ([]byte, error) {
+	s := outstream.New()
+	cmdErr := s.WriteUint8(cmd)
+	if cmdErr != nil {
+		return nil, cmdErr
+	}
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	octetsErr := s.WriteOctets(octets)
+	if octetsErr != nil {
+		return nil, octetsErr
+	}
+	return s.Octets(), nil
+}
+
+func serializeConnectionPacket(cmd PacketDirection, connectionID ConnectionID, monotonicTimeMs int64, octets []byte) ([]byte, error) {
+	s := outstream.New()
+	cmdErr := s.WriteUint8(cmd)
+	if cmdErr != nil {
+		return nil, cmdErr
 	}
-	if len(payload) < pktHeaderStateOctetCount {
-		return 0, fmt.Errorf("wrong serialized header size")
+	connectionErr := s.WriteUint32(uint32(connectionID))
+	if connectionErr != nil {
+		return nil, connectionErr
+	}
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	octetsErr := s.WriteOctets(octets)
+	if octetsErr != nil {
+		return nil, octetsErr
+	}
+	return s.Octets(), nil
+}
+
+func serializeConnectionEvent(event ConnectionEvent, connectionID ConnectionID, monotonicTimeMs int64) ([]byte, error) {
+	s := outstream.New()
+	eventErr := s.WriteUint8(uint8(event))
+	if eventErr != nil {
+		return nil, eventErr
+	}
+	connectionErr := s.WriteUint32(uint32(connectionID))
+	if connectionErr != nil {
+		return nil, connectionErr
+	}
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	return s.Octets(), nil
+}
+
+func serializeStatePacket(monotonicTimeMs int64, octets []byte) ([]byte, error) {
+	s := outstream.New()
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	octetsErr := s.WriteOctets(octets)
+	if octetsErr != nil {
+		return nil, octetsErr
+	}
+	return s.Octets(), nil
+}
+
+func serializeStateDelta(monotonicTimeMs int64, keyframePacketIndex PacketIndex, diff []byte) ([]byte, error) {
+	s := outstream.New()
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	keyframeErr := s.WriteUint32(uint32(keyframePacketIndex))
+	if keyframeErr != nil {
+		return nil, keyframeErr
+	}
+	diffErr := s.WriteOctets(diff)
+	if diffErr != nil {
+		return nil, diffErr
+	}
+	return s.Octets(), nil
+}
+
+func deserializeStateDeltaHeader(header piff.InHeader, payload []byte) (uint64, PacketIndex, error) {
+	checkErr := checkChunk(header, payload, "std1", pktHeaderStateDeltaOctetCount)
+	if checkErr != nil {
+		return 0, 0, checkErr
+	}
+	s := instream.New(payload)
+	monotonicTimeMs, timeMsErr := s.ReadUint64()
+	if timeMsErr != nil {
+		return 0, 0, timeMsErr
+	}
+	keyframePacketIndex, keyframeErr := s.ReadUint32()
+	if keyframeErr != nil {
+		return 0, 0, keyframeErr
+	}
+	return monotonicTimeMs, PacketIndex(keyframePacketIndex), nil
+}
+
+func deserializeStateDeltaFromPiffPayload(header piff.InHeader, payload []byte) (piff.ChunkIndex, uint64, PacketIndex, []byte, error) {
+	monotonicTimeMs, keyframePacketIndex, serializeErr := deserializeStateDeltaHeader(header, payload)
+	if serializeErr != nil {
+		return 0, 0, 0, nil, serializeErr
+	}
+	return header.ChunkIndex(), monotonicTimeMs, keyframePacketIndex, payload[pktHeaderStateDeltaOctetCount:], nil
+}
+
+func serializeAnnotation(monotonicTimeMs int64, label string, data []byte) ([]byte, error) {
+	if len(label) > 255 {
+		return nil, fmt.Errorf("annotation label is too long (%v octets)", len(label))
+	}
+	s := outstream.New()
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	labelErr := writeString(s, label)
+	if labelErr != nil {
+		return nil, labelErr
+	}
+	dataErr := s.WriteOctets(data)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	return s.Octets(), nil
+}
+
+func deserializeAnnotationHeader(header piff.InHeader, payload []byte) (uint64, error) {
+	checkErr := checkChunk(header, payload, "ann1", annotationHeaderOctetCount)
+	if checkErr != nil {
+		return 0, checkErr
+	}
+	s := instream.New(payload)
+	return s.ReadUint64()
+}
+
+func deserializeAnnotationFromPiffPayload(header piff.InHeader, payload []byte) (uint64, string, []byte, error) {
+	monotonicTimeMs, headerErr := deserializeAnnotationHeader(header, payload)
+	if headerErr != nil {
+		return 0, "", nil, headerErr
+	}
+	labelOctetCount := 0
+	if len(payload) > annotationHeaderOctetCount {
+		labelOctetCount = int(payload[annotationHeaderOctetCount])
+	}
+	dataStart := annotationHeaderOctetCount + 1 + labelOctetCount
+	if len(payload) < dataStart {
+		return 0, "", nil, &CorruptChunkError{ChunkIndex: int(header.ChunkIndex()), TypeID: header.TypeIDString(),
+			ExpectedOctetCount: dataStart, ActualOctetCount: len(payload)}
+	}
+	label := string(payload[annotationHeaderOctetCount+1 : dataStart])
+	return monotonicTimeMs, label, payload[dataStart:], nil
+}
+
+func serializeClockSync(monotonicTimeMs int64, wallClock time.Time) ([]byte, error) {
+	s := outstream.New()
+	timeErr := s.WriteUint64(uint64(monotonicTimeMs))
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	wallClockErr := s.WriteUint64(uint64(wallClock.UnixNano()))
+	if wallClockErr != nil {
+		return nil, wallClockErr
+	}
+	return s.Octets(), nil
+}
+
+func deserializeClockSync(header piff.InHeader, payload []byte) (uint64, time.Time, error) {
+	checkErr := checkChunk(header, payload, "clk1", clockSyncOctetCount)
+	if checkErr != nil {
+		return 0, time.Time{}, checkErr
+	}
+	s := instream.New(payload)
+	monotonicTimeMs, timeMsErr := s.ReadUint64()
+	if timeMsErr != nil {
+		return 0, time.Time{}, timeMsErr
+	}
+	unixNano, wallClockErr := s.ReadUint64()
+	if wallClockErr != nil {
+		return 0, time.Time{}, wallClockErr
+	}
+	return monotonicTimeMs, time.Unix(0, int64(unixNano)).UTC(), nil
+}
+
+func deserializeStateHeader(header piff.InHeader, payload []byte) (uint64, error) {
+	checkErr := checkChunk(header, payload, "sta1", pktHeaderStateOctetCount)
+	if checkErr != nil {
+		return 0, checkErr
 	}
 	s := instream.New(payload)
 	monotonicTimeMs, timeMsErr := s.ReadUint64()
@@ -60,58 +272,95 @@ func deserializeStateHeaderFromStream(stream *piff.InStream) (uint64, error) {
 }
 
 func deserializePacketHeader(header piff.InHeader, payload []byte) (PacketDirection, uint64, error) {
-	if header.TypeIDString() != "pkt1" {
-		return 0, 0, fmt.Errorf("wrong typeid %v", header)
-	}
-	if len(payload) < pktHeaderOctetCount {
-		return 0, 0, fmt.Errorf("wrong serialized header size")
+	checkErr := checkChunk(header, payload, "pkt1", pktHeaderOctetCount)
+	if checkErr != nil {
+		return 0, 0, checkErr
 	}
 	s := instream.New(payload)
-	cmdValue, cmdErr := s.ReadUint8()
+	cmdValue, cmdErr := readPacketDirection(header, s)
 	if cmdErr != nil {
 		return 0, 0, cmdErr
 	}
+	monotonicTimeMs, timeMsErr := s.ReadUint64()
+	if timeMsErr != nil {
+		return 0, 0, timeMsErr
+	}
+	return cmdValue, monotonicTimeMs, nil
+}
+
+func readPacketDirection(header piff.InHeader, s *instream.InStream) (PacketDirection, error) {
+	cmdValue, cmdErr := s.ReadUint8()
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
 	switch cmdValue {
 	case CmdIncomingPacket:
 	case CmdOutgoingPacket:
 	default:
-		return CmdIncomingPacket, 0, fmt.Errorf("unknown direction")
+		return CmdIncomingPacket, newCorruptChunkError(header, fmt.Sprintf("unknown direction %02x", cmdValue))
+	}
+	return cmdValue, nil
+}
+
+func deserializeConnectionPacketHeader(header piff.InHeader, payload []byte) (PacketDirection, ConnectionID, uint64, error) {
+	checkErr := checkChunk(header, payload, "pkt2", pktConnectionHeaderOctetCount)
+	if checkErr != nil {
+		return 0, 0, 0, checkErr
+	}
+	s := instream.New(payload)
+	cmdValue, cmdErr := readPacketDirection(header, s)
+	if cmdErr != nil {
+		return 0, 0, 0, cmdErr
+	}
+	connectionID, connectionErr := s.ReadUint32()
+	if connectionErr != nil {
+		return 0, 0, 0, connectionErr
 	}
 	monotonicTimeMs, timeMsErr := s.ReadUint64()
 	if timeMsErr != nil {
-		return 0, 0, timeMsErr
+		return 0, 0, 0, timeMsErr
 	}
-	return cmdValue, monotonicTimeMs, nil
+	return cmdValue, ConnectionID(connectionID), monotonicTimeMs, nil
 }
 
-func deserializePacketFromStream(stream *piff.InStream) (piff.ChunkIndex, PacketDirection, uint64, []byte, error) {
-	header, payload, readErr := stream.ReadChunk()
-	if readErr != nil {
-		return 0, CmdIncomingPacket, 0, nil, readErr
+func deserializeConnectionEvent(header piff.InHeader, payload []byte) (ConnectionEvent, ConnectionID, uint64, error) {
+	checkErr := checkChunk(header, payload, "con1", connectionEventOctetCount)
+	if checkErr != nil {
+		return 0, 0, 0, checkErr
 	}
-	return deserializePacketFromPiffPayload(header, payload)
-}
-
-func deserializePacketFromPiffPayload(header piff.InHeader, payload []byte) (piff.ChunkIndex, PacketDirection, uint64, []byte, error) {
-	pktHeaderOctets := payload[:pktHeaderOctetCount]
-	cmd, monotonicTimeMs, serializeErr := deserializePacketHeader(header, pktHeaderOctets)
-	if serializeErr != nil {
-		return 0, 0, 0, nil, serializeErr
+	s := instream.New(payload)
+	eventValue, eventErr := s.ReadUint8()
+	if eventErr != nil {
+		return 0, 0, 0, eventErr
+	}
+	connectionID, connectionErr := s.ReadUint32()
+	if connectionErr != nil {
+		return 0, 0, 0, connectionErr
+	}
+	monotonicTimeMs, timeMsErr := s.ReadUint64()
+	if timeMsErr != nil {
+		return 0, 0, 0, timeMsErr
 	}
-	return header.ChunkIndex(), cmd, monotonicTimeMs, payload[pktHeaderOctetCount:], nil
+	return ConnectionEvent(eventValue), ConnectionID(connectionID), monotonicTimeMs, nil
 }
 
-func deserializeStatePacketFromStream(stream *piff.InStream) (piff.ChunkIndex, uint64, []byte, error) {
-	header, payload, readErr := stream.ReadChunk()
-	if readErr != nil {
-		return 0, 0, nil, readErr
+func deserializeConnectionPacketFromPiffPayload(header piff.InHeader, payload []byte) (piff.ChunkIndex, ConnectionID, PacketDirection, uint64, []byte, error) {
+	if uncompressedTypeID(header.TypeIDString()) == "pkt2" {
+		cmd, connectionID, monotonicTimeMs, serializeErr := deserializeConnectionPacketHeader(header, payload)
+		if serializeErr != nil {
+			return 0, 0, 0, 0, nil, serializeErr
+		}
+		return header.ChunkIndex(), connectionID, cmd, monotonicTimeMs, payload[pktConnectionHeaderOctetCount:], nil
 	}
-	return deserializeStatePacketFromPiffPayload(header, payload)
+	cmd, monotonicTimeMs, serializeErr := deserializePacketHeader(header, payload)
+	if serializeErr != nil {
+		return 0, 0, 0, 0, nil, serializeErr
+	}
+	return header.ChunkIndex(), NoConnectionID, cmd, monotonicTimeMs, payload[pktHeaderOctetCount:], nil
 }
 
 func deserializeStatePacketFromPiffPayload(header piff.InHeader, payload []byte) (piff.ChunkIndex, uint64, []byte, error) {
-	stateHeaderOctets := payload[:pktHeaderStateOctetCount]
-	monotonicTimeMs, serializeErr := deserializeStateHeader(header, stateHeaderOctets)
+	monotonicTimeMs, serializeErr := deserializeStateHeader(header, payload)
 	if serializeErr != nil {
 		return 0, 0, nil, serializeErr
 	}
@@ -127,5 +376,9 @@ func deserializeSchemaTextFromStream(stream *piff.InStream) (string, error) {
 }
 
 func deserializeSchemaTextFromPiffPayload(header piff.InHeader, payload []byte) (string, error) {
+	checkErr := checkChunk(header, payload, "sch1", 0)
+	if checkErr != nil {
+		return "", checkErr
+	}
 	return string(payload), nil
 }
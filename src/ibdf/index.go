@@ -0,0 +1,159 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+
+	"github.com/piot/brook-go/src/instream"
+	"github.com/piot/brook-go/src/outstream"
+	"github.com/piot/piff-go/src/piff"
+)
+
+// indexVersion must be increased when the index entries change, so readers fall back to scanning older indexes.
+const indexVersion = 1
+
+const indexHeaderOctetCount = 1 + 4
+
+const indexEntryOctetCount = 4 + 1 + 1 + 4 + 8 + 8 + 4
+
+func serializeIndexEntry(out *outstream.OutStream, info HeaderInfo) error {
+	indexErr := out.WriteUint32(uint32(info.packetIndex))
+	if indexErr != nil {
+		return indexErr
+	}
+	typeErr := out.WriteUint8(uint8(info.packetType))
+	if typeErr != nil {
+		return typeErr
+	}
+	directionErr := out.WriteUint8(info.direction)
+	if directionErr != nil {
+		return directionErr
+	}
+	connectionErr := out.WriteUint32(uint32(info.connectionID))
+	if connectionErr != nil {
+		return connectionErr
+	}
+	timestampErr := out.WriteUint64(uint64(info.timestamp))
+	if timestampErr != nil {
+		return timestampErr
+	}
+	offsetErr := out.WriteUint64(uint64(info.offset))
+	if offsetErr != nil {
+		return offsetErr
+	}
+	return out.WriteUint32(uint32(info.octetCount))
+}
+
+func serializeIndex(entryCount int, entryOctets []byte) ([]byte, error) {
+	out := outstream.New()
+	versionErr := out.WriteUint8(indexVersion)
+	if versionErr != nil {
+		return nil, versionErr
+	}
+	countErr := out.WriteUint32(uint32(entryCount))
+	if countErr != nil {
+		return nil, countErr
+	}
+	entriesErr := out.WriteOctets(entryOctets)
+	if entriesErr != nil {
+		return nil, entriesErr
+	}
+	return out.Octets(), nil
+}
+
+func deserializeIndexEntry(in *instream.InStream) (*HeaderInfo, error) {
+	packetIndex, indexErr := in.ReadUint32()
+	if indexErr != nil {
+		return nil, indexErr
+	}
+	packetType, typeErr := in.ReadUint8()
+	if typeErr != nil {
+		return nil, typeErr
+	}
+	direction, directionErr := in.ReadUint8()
+	if directionErr != nil {
+		return nil, directionErr
+	}
+	connectionID, connectionErr := in.ReadUint32()
+	if connectionErr != nil {
+		return nil, connectionErr
+	}
+	timestamp, timestampErr := in.ReadUint64()
+	if timestampErr != nil {
+		return nil, timestampErr
+	}
+	offset, offsetErr := in.ReadUint64()
+	if offsetErr != nil {
+		return nil, offsetErr
+	}
+	octetCount, octetCountErr := in.ReadUint32()
+	if octetCountErr != nil {
+		return nil, octetCountErr
+	}
+
+	return &HeaderInfo{packetIndex: PacketIndex(packetIndex), packetType: PacketType(packetType),
+		direction: direction, connectionID: ConnectionID(connectionID), timestamp: int64(timestamp), offset: int64(offset), octetCount: int(octetCount)}, nil
+}
+
+func deserializeIndex(header piff.InHeader, payload []byte) ([]*HeaderInfo, error) {
+	checkErr := checkChunk(header, payload, "idx1", indexHeaderOctetCount)
+	if checkErr != nil {
+		return nil, checkErr
+	}
+	in := instream.New(payload)
+	version, versionErr := in.ReadUint8()
+	if versionErr != nil {
+		return nil, versionErr
+	}
+	if version != indexVersion {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("unsupported index version %v", version))
+	}
+	entryCount, countErr := in.ReadUint32()
+	if countErr != nil {
+		return nil, countErr
+	}
+	expectedOctetCount := indexHeaderOctetCount + int(entryCount)*indexEntryOctetCount
+	if len(payload) != expectedOctetCount {
+		return nil, &CorruptChunkError{ChunkIndex: int(header.ChunkIndex()), TypeID: header.TypeIDString(),
+			ExpectedOctetCount: expectedOctetCount, ActualOctetCount: len(payload),
+			Reason: fmt.Sprintf("index has %v entries, expected %v octets, but got %v", entryCount, expectedOctetCount, len(payload))}
+	}
+	infos := make([]*HeaderInfo, entryCount)
+	for i := range infos {
+		info, entryErr := deserializeIndexEntry(in)
+		if entryErr != nil {
+			return nil, entryErr
+		}
+		if int(info.packetIndex) != i {
+			return nil, newCorruptChunkError(header, fmt.Sprintf("entry %d has packet index %d", i, info.packetIndex))
+		}
+		infos[i] = info
+	}
+
+	return infos, nil
+}
@@ -31,6 +31,9 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/piot/brook-go/src/instream"
 	"github.com/piot/piff-go/src/piff"
@@ -44,14 +47,19 @@ const (
 	PacketTypeState PacketType = iota
 	PacketTypeNormal
 	PacketTypeOther
+	PacketTypeConnectionEvent
+	PacketTypeAnnotation
+	PacketTypeClockSync
 )
 
 type HeaderInfo struct {
-	packetIndex PacketIndex
-	packetType  PacketType
-	timestamp   int64
-	direction   PacketDirection
-	octetCount  int
+	packetIndex  PacketIndex
+	packetType   PacketType
+	timestamp    int64
+	direction    PacketDirection
+	connectionID ConnectionID
+	offset       int64
+	octetCount   int
 }
 
 func (h HeaderInfo) PacketIndex() PacketIndex {
@@ -70,10 +78,19 @@ func (h HeaderInfo) PacketDirection() PacketDirection {
 	return h.direction
 }
 
+func (h HeaderInfo) ConnectionID() ConnectionID {
+	return h.connectionID
+}
+
 func (h HeaderInfo) OctetCount() int {
 	return h.octetCount
 }
 
+// Offset is the position of the chunk in the file, or -1 if it is not known.
+func (h HeaderInfo) Offset() int64 {
+	return h.offset
+}
+
 func (h HeaderInfo) String() string {
 	return fmt.Sprintf("index:%v type:%v time:%v octetCount:%v", h.packetIndex, h.packetType, h.timestamp, h.octetCount)
 }
@@ -82,10 +99,20 @@ type InPacketFile struct {
 	inFile        *piff.InSeeker
 	schemaPayload []byte
 	infos         []*HeaderInfo
+	states        timeIndex
+	packets       timeIndex
 	header        Header
 
+	wallClockAnchors       wallClockAnchors
+	wallClockAnchorsLoaded bool
+	wallClockAnchorsLock   sync.Mutex
+
 	startTime int64
 	endTime   int64
+
+	chunks *chunkReaderAt
+	mapped *mappedChunks
+	closer io.Closer
 }
 
 func (c *InPacketFile) AllHeaders() []*HeaderInfo {
@@ -142,14 +169,14 @@ func readNameAndVersion(stream *instream.InStream) (NameAndVersion, error) {
 	return nameAndVersion, nil
 }
 
-func readHeader(in *instream.InStream) (Header, error) {
+func readHeader(in *instream.InStream, octetCount int) (Header, error) {
 	var header Header
 
 	var err error
 
 	header.CompanyName, err = readString(in)
 	if err != nil {
-		return header, nil
+		return header, err
 	}
 	header.Application, err = readNameAndVersion(in)
 	if err != nil {
@@ -167,7 +194,27 @@ func readHeader(in *instream.InStream) (Header, error) {
 	}
 
 	header.Protocol, err = readNameAndVersion(in)
-	return header, err
+	if err != nil {
+		return header, err
+	}
+
+	if octetCount > header.serializedOctetCountWithoutOptionals() {
+		compression, compressionErr := in.ReadUint8()
+		if compressionErr != nil {
+			return header, compressionErr
+		}
+		header.Compression = Compression(compression)
+	}
+
+	if octetCount > header.serializedOctetCountWithoutOptionals()+1 {
+		flags, flagsErr := in.ReadUint8()
+		if flagsErr != nil {
+			return header, flagsErr
+		}
+		header.Checksums = flags&headerFlagChecksums != 0
+	}
+
+	return header, checkCompression(header.Compression)
 }
 
 func (c *InPacketFile) readHeader(piffStream *piff.InSeeker) (Header, error) {
@@ -180,18 +227,91 @@ func (c *InPacketFile) readHeader(piffStream *piff.InSeeker) (Header, error) {
 	}
 
 	stream := instream.New(payload)
-	return readHeader(stream)
+	return readHeader(stream, len(payload))
+}
+
+func packetTypeFromTypeID(id string) PacketType {
+	switch uncompressedTypeID(id) {
+	case "sta1", "std1":
+		return PacketTypeState
+	case "pkt1", "pkt2":
+		return PacketTypeNormal
+	case "con1":
+		return PacketTypeConnectionEvent
+	case "ann1":
+		return PacketTypeAnnotation
+	case "clk1":
+		return PacketTypeClockSync
+	default:
+		return PacketTypeOther
+	}
+}
+
+func (c *InPacketFile) loadIndex() bool {
+	allHeaders := c.inFile.AllHeaders()
+	indexChunkIndex := len(allHeaders) - 1
+	if indexChunkIndex < 0 || allHeaders[indexChunkIndex].Header().TypeIDString() != "idx1" {
+		return false
+	}
+	header, payload, readErr := c.inFile.FindChunk(indexChunkIndex)
+	if readErr != nil {
+		return false
+	}
+	infos, deserializeErr := deserializeIndex(header, payload)
+	if deserializeErr != nil || len(infos) != indexChunkIndex {
+		return false
+	}
+	for packetIndex, info := range infos {
+		header := allHeaders[packetIndex].Header()
+		if info.packetType != packetTypeFromTypeID(header.TypeIDString()) || info.octetCount != header.OctetCount() {
+			return false
+		}
+	}
+	c.setInfos(infos)
+	return true
+}
+
+func (c *InPacketFile) setInfos(infos []*HeaderInfo) {
+	c.infos = infos
+	c.states = newTimeIndex(infos, PacketTypeState)
+	c.packets = newTimeIndex(infos, PacketTypeNormal)
+}
+
+func (c *InPacketFile) hasSomeState() bool {
+	return len(c.states.infos) > 0
+}
+
+// loadOrScanAllChunks finds all chunks. Captures without states, e.g. from ibdf-record, are valid, but can not
+// be used to seek to a state.
+func (c *InPacketFile) loadOrScanAllChunks() error {
+	if !c.loadIndex() {
+		return c.scanAllChunks()
+	}
+	return nil
+}
+
+// chunkOffsets returns the position of every chunk in the file, from the chunk octet counts.
+func chunkOffsets(allHeaders []*piff.SeekHeader) []int64 {
+	offsets := make([]int64, len(allHeaders))
+	offset := int64(0)
+	for packetIndex, seekHeader := range allHeaders {
+		offsets[packetIndex] = offset
+		offset += piffChunkHeaderOctetCount + int64(seekHeader.Header().OctetCount())
+	}
+	return offsets
 }
 
 func (c *InPacketFile) scanAllChunks() error {
 	var infos []*HeaderInfo
-	foundSomeState := false
-	for packetIndex, seekHeader := range c.inFile.AllHeaders() {
-		id := seekHeader.Header().TypeIDString()
+	allHeaders := c.inFile.AllHeaders()
+	offsets := chunkOffsets(allHeaders)
+	for packetIndex, seekHeader := range allHeaders {
+		id := uncompressedTypeID(seekHeader.Header().TypeIDString())
+		octetCount := seekHeader.Header().OctetCount()
 		var headerInfo *HeaderInfo
 		switch id {
 		case "pac1":
-			headerInfo = &HeaderInfo{packetType: PacketTypeOther, packetIndex: PacketIndex(packetIndex), direction: CmdIncomingPacket}
+			headerInfo = &HeaderInfo{packetType: PacketTypeOther, packetIndex: PacketIndex(packetIndex), direction: CmdIncomingPacket, offset: offsets[packetIndex], octetCount: octetCount}
 		case "sta1":
 			header, octets, foundErr := c.inFile.FindPartialChunk(packetIndex, 8)
 			if foundErr != nil {
@@ -202,8 +322,17 @@ func (c *InPacketFile) scanAllChunks() error {
 			if timestampErr != nil {
 				return timestampErr
 			}
-			headerInfo = &HeaderInfo{packetType: PacketTypeState, packetIndex: PacketIndex(packetIndex), timestamp: int64(timestamp), octetCount: header.OctetCount()}
-			foundSomeState = true
+			headerInfo = &HeaderInfo{packetType: PacketTypeState, packetIndex: PacketIndex(packetIndex), timestamp: int64(timestamp), offset: offsets[packetIndex], octetCount: header.OctetCount()}
+		case "std1":
+			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, pktHeaderStateDeltaOctetCount)
+			if foundErr != nil {
+				return foundErr
+			}
+			time, _, deserializeErr := deserializeStateDeltaHeader(header, payload)
+			if deserializeErr != nil {
+				return deserializeErr
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeState, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), offset: offsets[packetIndex], octetCount: header.OctetCount()}
 		case "pkt1":
 			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, pktHeaderOctetCount)
 			if foundErr != nil {
@@ -213,19 +342,61 @@ func (c *InPacketFile) scanAllChunks() error {
 			if deserializeErr != nil {
 				return deserializeErr
 			}
-			headerInfo = &HeaderInfo{packetType: PacketTypeNormal, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: direction, octetCount: header.OctetCount()}
+			headerInfo = &HeaderInfo{packetType: PacketTypeNormal, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: direction, offset: offsets[packetIndex], octetCount: header.OctetCount()}
+		case "pkt2":
+			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, pktConnectionHeaderOctetCount)
+			if foundErr != nil {
+				return foundErr
+			}
+			direction, connectionID, time, deserializeErr := deserializeConnectionPacketHeader(header, payload)
+			if deserializeErr != nil {
+				return deserializeErr
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeNormal, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: direction, connectionID: connectionID, offset: offsets[packetIndex], octetCount: header.OctetCount()}
+		case "con1":
+			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, connectionEventOctetCount)
+			if foundErr != nil {
+				return foundErr
+			}
+			_, connectionID, time, deserializeErr := deserializeConnectionEvent(header, payload)
+			if deserializeErr != nil {
+				return deserializeErr
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeConnectionEvent, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: CmdIncomingPacket, connectionID: connectionID, offset: offsets[packetIndex], octetCount: header.OctetCount()}
+		case "ann1":
+			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, annotationHeaderOctetCount)
+			if foundErr != nil {
+				return foundErr
+			}
+			time, deserializeErr := deserializeAnnotationHeader(header, payload)
+			if deserializeErr != nil {
+				return deserializeErr
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeAnnotation, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: CmdIncomingPacket, offset: offsets[packetIndex], octetCount: header.OctetCount()}
+		case "clk1":
+			header, payload, foundErr := c.inFile.FindPartialChunk(packetIndex, clockSyncOctetCount)
+			if foundErr != nil {
+				return foundErr
+			}
+			time, _, deserializeErr := deserializeClockSync(header, payload)
+			if deserializeErr != nil {
+				return deserializeErr
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeClockSync, packetIndex: PacketIndex(packetIndex), timestamp: int64(time), direction: CmdIncomingPacket, offset: offsets[packetIndex], octetCount: header.OctetCount()}
 		case "sch1": // do nothing
-			headerInfo = &HeaderInfo{packetType: PacketTypeOther, packetIndex: PacketIndex(packetIndex), direction: CmdIncomingPacket}
+			headerInfo = &HeaderInfo{packetType: PacketTypeOther, packetIndex: PacketIndex(packetIndex), direction: CmdIncomingPacket, offset: offsets[packetIndex], octetCount: octetCount}
+		case "idx1":
+			if packetIndex == len(allHeaders)-1 {
+				continue
+			}
+			headerInfo = &HeaderInfo{packetType: PacketTypeOther, packetIndex: PacketIndex(packetIndex), direction: CmdIncomingPacket, offset: offsets[packetIndex], octetCount: octetCount}
 		default:
 			return fmt.Errorf("unknown type id %s", id)
 		}
 		infos = append(infos, headerInfo)
 	}
 
-	c.infos = infos
-	if !foundSomeState {
-		return &MissingStateError{}
-	}
+	c.setInfos(infos)
 
 	return nil
 }
@@ -234,6 +405,10 @@ func (c *InPacketFile) getInfo(packetIndex PacketIndex) *HeaderInfo {
 	return c.infos[packetIndex]
 }
 
+func (c *InPacketFile) typeID(packetIndex PacketIndex) string {
+	return c.inFile.AllHeaders()[packetIndex].Header().TypeIDString()
+}
+
 func (c *InPacketFile) IsState(packetIndex PacketIndex) bool {
 	if c.IsEOF(packetIndex) {
 		return false
@@ -250,19 +425,60 @@ func (c *InPacketFile) IsPacket(packetIndex PacketIndex) bool {
 	return info.packetType == PacketTypeNormal
 }
 
-func (c *InPacketFile) FindClosestStateBeforeOrAt(timestamp int64) *HeaderInfo {
-	var foundStateInfo *HeaderInfo
+func (c *InPacketFile) IsConnectionEvent(packetIndex PacketIndex) bool {
+	if c.IsEOF(packetIndex) {
+		return false
+	}
+	info := c.getInfo(packetIndex)
+	return info.packetType == PacketTypeConnectionEvent
+}
 
+func (c *InPacketFile) IsAnnotation(packetIndex PacketIndex) bool {
+	if c.IsEOF(packetIndex) {
+		return false
+	}
+	info := c.getInfo(packetIndex)
+	return info.packetType == PacketTypeAnnotation
+}
+
+func (c *InPacketFile) Annotations() []*HeaderInfo {
+	var annotations []*HeaderInfo
 	for _, info := range c.infos {
-		if info.packetType != PacketTypeState {
+		if info.packetType == PacketTypeAnnotation {
+			annotations = append(annotations, info)
+		}
+	}
+	return annotations
+}
+
+// ConnectionIDs returns all connections that have packets or events in the file, in the order they first appear.
+func (c *InPacketFile) ConnectionIDs() []ConnectionID {
+	var connectionIDs []ConnectionID
+	found := make(map[ConnectionID]bool)
+	for _, info := range c.infos {
+		if info.packetType != PacketTypeNormal && info.packetType != PacketTypeConnectionEvent {
 			continue
 		}
-		if info.timestamp > timestamp {
-			return foundStateInfo
+		if found[info.connectionID] {
+			continue
 		}
-		foundStateInfo = info
+		found[info.connectionID] = true
+		connectionIDs = append(connectionIDs, info.connectionID)
 	}
-	return foundStateInfo
+	return connectionIDs
+}
+
+func (c *InPacketFile) FindClosestStateBeforeOrAt(timestamp int64) *HeaderInfo {
+	return c.states.lastBeforeOrAt(timestamp)
+}
+
+func (c *InPacketFile) FindFirstPacketAtOrAfter(timestamp int64) *HeaderInfo {
+	return c.packets.firstAtOrAfterInfo(timestamp)
+}
+
+// FindPacketsInTimeRange returns the packets with a timestamp from startTimestamp up to, but not including, endTimestamp.
+func (c *InPacketFile) FindPacketsInTimeRange(startTimestamp int64, endTimestamp int64) []*HeaderInfo {
+	return c.packets.inRange(startTimestamp, endTimestamp)
 }
 
 func NewInPacketFile(filename string) (*InPacketFile, error) {
@@ -278,6 +494,45 @@ func NewInPacketFileFromSeeker(readSeeker io.ReadSeeker) (*InPacketFile, error)
 	if err != nil {
 		return nil, err
 	}
+	return newInPacketFile(newPiffFile)
+}
+
+// NewInPacketFileFromReaderAt creates a file that is safe to read from several goroutines at the same time,
+// e.g. with one InPacketFileSequence per goroutine. The readerAt must support concurrent ReadAt calls, as *os.File does.
+// Closing a sequence does not close the shared file, close the InPacketFile when all sequences are done.
+func NewInPacketFileFromReaderAt(readerAt io.ReaderAt, octetCount int64) (*InPacketFile, error) {
+	newPiffFile, err := piff.NewInSeeker(io.NewSectionReader(readerAt, 0, octetCount))
+	if err != nil {
+		return nil, err
+	}
+	c, err := newInPacketFile(newPiffFile)
+	if err != nil {
+		return nil, err
+	}
+	c.chunks = newChunkReaderAt(readerAt, newPiffFile.AllHeaders())
+	return c, nil
+}
+
+func NewConcurrentInPacketFile(filename string) (*InPacketFile, error) {
+	file, openErr := os.Open(path.Clean(filename))
+	if openErr != nil {
+		return nil, openErr
+	}
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return nil, statErr
+	}
+	c, err := NewInPacketFileFromReaderAt(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.closer = file
+	return c, nil
+}
+
+func newInPacketFile(newPiffFile *piff.InSeeker) (*InPacketFile, error) {
 	c := &InPacketFile{
 		inFile: newPiffFile,
 	}
@@ -293,13 +548,40 @@ func NewInPacketFileFromSeeker(readSeeker io.ReadSeeker) (*InPacketFile, error)
 	}
 	c.schemaPayload = schemaOctets
 
-	scanChunksErr := c.scanAllChunks()
+	scanChunksErr := c.loadOrScanAllChunks()
 	if scanChunksErr != nil {
 		return c, scanChunksErr
 	}
 	return c, err
 }
 
+func (c *InPacketFile) findPiffChunk(packetIndex PacketIndex) (piff.InHeader, []byte, error) {
+	if c.mapped != nil {
+		return c.mapped.findChunk(int(packetIndex))
+	}
+	if c.chunks != nil {
+		return c.chunks.findChunk(int(packetIndex))
+	}
+	return c.inFile.FindChunk(int(packetIndex))
+}
+
+// isShared reports if the file can be used by several sequences at the same time.
+func (c *InPacketFile) isShared() bool {
+	return c.chunks != nil || c.mapped != nil
+}
+
+func (c *InPacketFile) findChunk(packetIndex PacketIndex) (piff.InHeader, []byte, error) {
+	header, payload, readErr := c.findPiffChunk(packetIndex)
+	if readErr != nil {
+		return header, nil, readErr
+	}
+	octets, checksumErr := stripChecksum(c.header.Checksums, header, payload)
+	if checksumErr != nil {
+		return header, nil, checksumErr
+	}
+	return header, octets, nil
+}
+
 func (c *InPacketFile) IsEOF(packetIndex PacketIndex) bool {
 	return int(packetIndex) >= len(c.infos)
 }
@@ -311,11 +593,44 @@ func (c *InPacketFile) ReadPacket(packetIndex PacketIndex) (piff.ChunkIndex, Pac
 	if c.IsState(packetIndex) {
 		return 0, 0, 0, nil, fmt.Errorf("read packet (%v): wrong packet type (encountered a state)", packetIndex)
 	}
-	header, payload, readErr := c.inFile.FindChunk(int(packetIndex))
+	chunkIndex, _, direction, time, payload, readErr := c.ReadConnectionPacket(packetIndex)
+	return chunkIndex, direction, time, payload, readErr
+}
+
+func (c *InPacketFile) ReadConnectionPacket(packetIndex PacketIndex) (piff.ChunkIndex, ConnectionID, PacketDirection, uint64, []byte, error) {
+	if c.IsEOF(packetIndex) {
+		return 0, 0, 0, 0, nil, io.EOF
+	}
+	if !c.IsPacket(packetIndex) {
+		return 0, 0, 0, 0, nil, fmt.Errorf("read connection packet (%v): wrong packet type", packetIndex)
+	}
+	header, payload, readErr := c.findChunk(packetIndex)
+	if readErr != nil {
+		return 0, 0, 0, 0, nil, readErr
+	}
+	chunkIndex, connectionID, direction, time, octets, deserializeErr := deserializeConnectionPacketFromPiffPayload(header, payload)
+	if deserializeErr != nil {
+		return 0, 0, 0, 0, nil, deserializeErr
+	}
+	decompressed, decompressErr := decompressOctets(header, octets)
+	if decompressErr != nil {
+		return 0, 0, 0, 0, nil, decompressErr
+	}
+	return chunkIndex, connectionID, direction, time, decompressed, nil
+}
+
+func (c *InPacketFile) ReadConnectionEvent(packetIndex PacketIndex) (ConnectionEvent, ConnectionID, uint64, error) {
+	if c.IsEOF(packetIndex) {
+		return 0, 0, 0, io.EOF
+	}
+	if !c.IsConnectionEvent(packetIndex) {
+		return 0, 0, 0, fmt.Errorf("read connection event (%v): wrong packet type", packetIndex)
+	}
+	header, payload, readErr := c.findChunk(packetIndex)
 	if readErr != nil {
-		return 0, 0, 0, nil, readErr
+		return 0, 0, 0, readErr
 	}
-	return deserializePacketFromPiffPayload(header, payload)
+	return deserializeConnectionEvent(header, payload)
 }
 
 func (c *InPacketFile) ReadStatePacket(packetIndex PacketIndex) (piff.ChunkIndex, uint64, []byte, error) {
@@ -325,13 +640,112 @@ func (c *InPacketFile) ReadStatePacket(packetIndex PacketIndex) (piff.ChunkIndex
 	if !c.IsState(packetIndex) {
 		return 0, 0, nil, fmt.Errorf("read state packet (%v): wrong packet type", packetIndex)
 	}
-	header, payload, readErr := c.inFile.FindChunk(int(packetIndex))
+	header, payload, readErr := c.findChunk(packetIndex)
 	if readErr != nil {
 		return 0, 0, nil, readErr
 	}
-	return deserializeStatePacketFromPiffPayload(header, payload)
+	if uncompressedTypeID(header.TypeIDString()) == "std1" {
+		return c.readStateDelta(packetIndex, header, payload)
+	}
+	chunkIndex, time, octets, deserializeErr := deserializeStatePacketFromPiffPayload(header, payload)
+	if deserializeErr != nil {
+		return 0, 0, nil, deserializeErr
+	}
+	decompressed, decompressErr := decompressOctets(header, octets)
+	if decompressErr != nil {
+		return 0, 0, nil, decompressErr
+	}
+	return chunkIndex, time, decompressed, nil
+}
+
+func (c *InPacketFile) ReadAnnotation(packetIndex PacketIndex) (uint64, string, []byte, error) {
+	if c.IsEOF(packetIndex) {
+		return 0, "", nil, io.EOF
+	}
+	if !c.IsAnnotation(packetIndex) {
+		return 0, "", nil, fmt.Errorf("read annotation (%v): wrong packet type", packetIndex)
+	}
+	header, payload, readErr := c.findChunk(packetIndex)
+	if readErr != nil {
+		return 0, "", nil, readErr
+	}
+	return deserializeAnnotationFromPiffPayload(header, payload)
+}
+
+func (c *InPacketFile) loadWallClockAnchors() error {
+	c.wallClockAnchorsLock.Lock()
+	defer c.wallClockAnchorsLock.Unlock()
+	if c.wallClockAnchorsLoaded {
+		return nil
+	}
+	var syncs []clockSync
+	for _, info := range c.infos {
+		if info.packetType != PacketTypeClockSync {
+			continue
+		}
+		header, payload, readErr := c.findChunk(info.packetIndex)
+		if readErr != nil {
+			return readErr
+		}
+		monotonicTimeMs, wallClock, deserializeErr := deserializeClockSync(header, payload)
+		if deserializeErr != nil {
+			return deserializeErr
+		}
+		syncs = append(syncs, clockSync{monotonicTimeMs: int64(monotonicTimeMs), wallClock: wallClock})
+	}
+	sort.SliceStable(syncs, func(a, b int) bool {
+		return syncs[a].monotonicTimeMs < syncs[b].monotonicTimeMs
+	})
+	c.wallClockAnchors = wallClockAnchors{syncs: syncs}
+	c.wallClockAnchorsLoaded = true
+	return nil
+}
+
+// WallClockTime converts a monotonic timestamp, e.g. HeaderInfo.Timestamp(), to wall clock time, using the closest
+// earlier wall clock sync in the file. Returns an error if the file has no wall clock syncs.
+func (c *InPacketFile) WallClockTime(monotonicTimeMs int64) (time.Time, error) {
+	loadErr := c.loadWallClockAnchors()
+	if loadErr != nil {
+		return time.Time{}, loadErr
+	}
+	return c.wallClockAnchors.toWallClock(monotonicTimeMs)
+}
+
+// WallClockStartTime is the wall clock time of the first wall clock sync.
+func (c *InPacketFile) WallClockStartTime() (time.Time, error) {
+	loadErr := c.loadWallClockAnchors()
+	if loadErr != nil {
+		return time.Time{}, loadErr
+	}
+	return c.wallClockAnchors.startTime()
+}
+
+func (c *InPacketFile) readStateDelta(packetIndex PacketIndex, header piff.InHeader, payload []byte) (piff.ChunkIndex, uint64, []byte, error) {
+	chunkIndex, time, keyframePacketIndex, compressedDiff, deserializeErr := deserializeStateDeltaFromPiffPayload(header, payload)
+	if deserializeErr != nil {
+		return 0, 0, nil, deserializeErr
+	}
+	if keyframePacketIndex >= packetIndex {
+		return 0, 0, nil, fmt.Errorf("read state delta (%v): keyframe %v must be before the delta", packetIndex, keyframePacketIndex)
+	}
+	_, _, keyframe, keyframeErr := c.ReadStatePacket(keyframePacketIndex)
+	if keyframeErr != nil {
+		return 0, 0, nil, keyframeErr
+	}
+	diff, decompressErr := decompressOctets(header, compressedDiff)
+	if decompressErr != nil {
+		return 0, 0, nil, decompressErr
+	}
+	state, applyErr := applyDiff(header, keyframe, diff)
+	if applyErr != nil {
+		return 0, 0, nil, applyErr
+	}
+	return chunkIndex, time, state, nil
 }
 
 func (c *InPacketFile) Close() {
 	c.inFile.Close()
+	if c.closer != nil {
+		c.closer.Close()
+	}
 }
@@ -32,8 +32,10 @@ import (
 )
 
 type InPacketFileSequence struct {
-	inFile            *InPacketFile
-	cursorPacketIndex PacketIndex
+	inFile             *InPacketFile
+	cursorPacketIndex  PacketIndex
+	filterOnConnection bool
+	connectionID       ConnectionID
 }
 
 func (c *InPacketFileSequence) CursorAtState() bool {
@@ -52,7 +54,21 @@ func (c *InPacketFileSequence) CursorAtPacket() bool {
 	return info.packetType == PacketTypeNormal
 }
 
+func (c *InPacketFileSequence) cursorAtWantedPacket() bool {
+	if !c.CursorAtPacket() {
+		return false
+	}
+	if !c.filterOnConnection {
+		return true
+	}
+	info := c.inFile.getInfo(c.cursorPacketIndex)
+	return info.connectionID == c.connectionID
+}
+
 func (c *InPacketFileSequence) seekToClosestState(timestamp int64) error {
+	if !c.inFile.hasSomeState() {
+		return &MissingStateError{}
+	}
 	headerInfo := c.inFile.FindClosestStateBeforeOrAt(timestamp)
 	if headerInfo == nil {
 		return fmt.Errorf("couldn't find any states at timestamp %d", timestamp)
@@ -82,6 +98,19 @@ func NewInPacketFileSequenceFromInFile(inFile *InPacketFile) (*InPacketFileSeque
 	return c, nil
 }
 
+// NewInPacketFileSequenceForConnection creates a sequence that only returns the packets of the specified connection.
+// States are shared by all connections and are always returned.
+func NewInPacketFileSequenceForConnection(inFile *InPacketFile, connectionID ConnectionID) (*InPacketFileSequence, error) {
+	c, err := NewInPacketFileSequenceFromInFile(inFile)
+	if err != nil {
+		return nil, err
+	}
+	c.filterOnConnection = true
+	c.connectionID = connectionID
+
+	return c, nil
+}
+
 func (c *InPacketFileSequence) advanceCursor() {
 	c.cursorPacketIndex++
 }
@@ -91,21 +120,30 @@ func (c *InPacketFileSequence) IsEOF() bool {
 }
 
 func (c *InPacketFileSequence) ReadNextPacket() (PacketDirection, uint64, []byte, error) {
-	if c.IsEOF() {
-		return 0, 0, nil, io.EOF
-	}
-	for c.CursorAtState() {
+	_, direction, time, payload, readErr := c.ReadNextConnectionPacket()
+	return direction, time, payload, readErr
+}
+
+func (c *InPacketFileSequence) skipToWantedPacket() *HeaderInfo {
+	for !c.IsEOF() && !c.cursorAtWantedPacket() {
 		c.advanceCursor()
 	}
 	if c.IsEOF() {
-		return 0, 0, nil, io.EOF
+		return nil
+	}
+	return c.inFile.getInfo(c.cursorPacketIndex)
+}
+
+func (c *InPacketFileSequence) ReadNextConnectionPacket() (ConnectionID, PacketDirection, uint64, []byte, error) {
+	if c.skipToWantedPacket() == nil {
+		return 0, 0, 0, nil, io.EOF
 	}
-	_, direction, time, payload, readErr := c.inFile.ReadPacket(c.cursorPacketIndex)
+	_, connectionID, direction, time, payload, readErr := c.inFile.ReadConnectionPacket(c.cursorPacketIndex)
 	if readErr != nil {
-		return 0, 0, nil, readErr
+		return 0, 0, 0, nil, readErr
 	}
 	c.advanceCursor()
-	return direction, time, payload, nil
+	return connectionID, direction, time, payload, nil
 }
 
 func (c *InPacketFileSequence) ReadNextStatePacket() (uint64, []byte, error) {
@@ -120,6 +158,110 @@ func (c *InPacketFileSequence) ReadNextStatePacket() (uint64, []byte, error) {
 	return time, payload, nil
 }
 
+func (c *InPacketFileSequence) isWanted(packetIndex PacketIndex) bool {
+	info := c.inFile.getInfo(packetIndex)
+	switch info.packetType {
+	case PacketTypeState:
+		return true
+	case PacketTypeNormal:
+		return !c.filterOnConnection || info.connectionID == c.connectionID
+	default:
+		return false
+	}
+}
+
+func (c *InPacketFileSequence) readRecord(packetIndex PacketIndex) (Record, error) {
+	record := Record{typeID: c.inFile.typeID(packetIndex)}
+	if c.inFile.IsState(packetIndex) {
+		chunkIndex, time, payload, readErr := c.inFile.ReadStatePacket(packetIndex)
+		if readErr != nil {
+			return Record{}, readErr
+		}
+		record.recordType = RecordTypeState
+		record.chunkIndex = chunkIndex
+		record.timestamp = time
+		record.payload = payload
+		return record, nil
+	}
+	chunkIndex, connectionID, direction, time, payload, readErr := c.inFile.ReadConnectionPacket(packetIndex)
+	if readErr != nil {
+		return Record{}, readErr
+	}
+	record.recordType = RecordTypePacket
+	record.chunkIndex = chunkIndex
+	record.connectionID = connectionID
+	record.direction = direction
+	record.timestamp = time
+	record.payload = payload
+	return record, nil
+}
+
+// Peek returns the next state or packet without moving the cursor.
+func (c *InPacketFileSequence) Peek() (Record, error) {
+	packetIndex := c.cursorPacketIndex
+	for int(packetIndex) < len(c.inFile.infos) && !c.isWanted(packetIndex) {
+		packetIndex++
+	}
+	if int(packetIndex) >= len(c.inFile.infos) {
+		return Record{}, io.EOF
+	}
+	return c.readRecord(packetIndex)
+}
+
+// StepBack moves the cursor to the previous state or packet, so it is returned again by the next read.
+func (c *InPacketFileSequence) StepBack() error {
+	packetIndex := c.cursorPacketIndex
+	for packetIndex > 2 {
+		packetIndex--
+		if c.isWanted(packetIndex) {
+			c.cursorPacketIndex = packetIndex
+			return nil
+		}
+	}
+	return fmt.Errorf("can not step back from the first packet")
+}
+
+func (c *InPacketFileSequence) SeekToPacketIndex(packetIndex PacketIndex) error {
+	if packetIndex < 2 || int(packetIndex) > len(c.inFile.infos) {
+		return fmt.Errorf("packet index %v is out of range", packetIndex)
+	}
+	c.cursorPacketIndex = packetIndex
+	return nil
+}
+
+// SeekToTime returns the closest state before or at the timestamp and the packets from that state up to the
+// timestamp. The cursor is left at the first chunk at or after the timestamp.
+func (c *InPacketFileSequence) SeekToTime(timestamp int64) (Record, []Record, error) {
+	seekErr := c.seekToClosestState(timestamp)
+	if seekErr != nil {
+		return Record{}, nil, seekErr
+	}
+	state, stateErr := c.readRecord(c.cursorPacketIndex)
+	if stateErr != nil {
+		return Record{}, nil, stateErr
+	}
+	c.advanceCursor()
+
+	var packets []Record
+	for !c.IsEOF() && c.inFile.getInfo(c.cursorPacketIndex).timestamp < timestamp {
+		if c.cursorAtWantedPacket() {
+			packet, packetErr := c.readRecord(c.cursorPacketIndex)
+			if packetErr != nil {
+				return Record{}, nil, packetErr
+			}
+			packets = append(packets, packet)
+		}
+		c.advanceCursor()
+	}
+
+	return state, packets, nil
+}
+
+// Close closes the file of the sequence, unless the file is shared with other sequences. Shared files are closed with
+// InPacketFile.Close.
 func (c *InPacketFileSequence) Close() {
+	if c.inFile.isShared() {
+		return
+	}
 	c.inFile.Close()
 }
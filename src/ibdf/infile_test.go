@@ -0,0 +1,620 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, filename string) {
+	f, outErr := NewOutPacketFile(filename, Header{CompanyName: "SomeCompany"}, []byte("schema"))
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	writeErr := f.DebugState([]byte("first state"), 10)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("in"), 12)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugOutgoingPacket([]byte("out"), 15)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugState([]byte("second state"), 20)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugOutgoingPacket([]byte("last"), 25)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	const ibdFilename = "test_index.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	indexed := pf.AllHeaders()
+	if len(indexed) != 7 {
+		t.Fatalf("expected 7 headers, got %v", len(indexed))
+	}
+	if indexed[2].Offset() <= indexed[1].Offset() {
+		t.Errorf("offsets should be increasing %v %v", indexed[1].Offset(), indexed[2].Offset())
+	}
+
+	scanErr := pf.scanAllChunks()
+	if scanErr != nil {
+		t.Fatal(scanErr)
+	}
+	scanned := pf.AllHeaders()
+	if len(scanned) != len(indexed) {
+		t.Fatalf("index has %v headers, scan found %v", len(indexed), len(scanned))
+	}
+	for i, info := range indexed {
+		other := scanned[i]
+		if info.PacketIndex() != other.PacketIndex() || info.PacketType() != other.PacketType() ||
+			info.Timestamp() != other.Timestamp() || info.OctetCount() != other.OctetCount() || info.Offset() != other.Offset() {
+			t.Errorf("index %v differs from scan %v", info, other)
+		}
+		if info.PacketType() == PacketTypeNormal && info.PacketDirection() != other.PacketDirection() {
+			t.Errorf("index direction %v differs from scan %v", info.PacketDirection(), other.PacketDirection())
+		}
+	}
+}
+
+func TestUnsupportedIndexVersionFallsBackToScan(t *testing.T) {
+	const ibdFilename = "test_index_version.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	file, openErr := os.OpenFile(ibdFilename, os.O_RDWR, 0)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	indexOctetCount := int64(indexHeaderOctetCount + 7*indexEntryOctetCount)
+	_, writeErr := file.WriteAt([]byte{indexVersion + 1}, stat.Size()-indexOctetCount)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	corruptChunks, verifyErr := Verify(file)
+	if verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+	var corruptErr *CorruptChunkError
+	if len(corruptChunks) != 1 || corruptChunks[0].TypeID != "idx1" || !errors.As(corruptChunks[0].Err, &corruptErr) {
+		t.Fatalf("expected the index to be reported as corrupt, got %v", corruptChunks)
+	}
+
+	pf, inErr := NewInPacketFile(ibdFilename)
+	if inErr != nil {
+		t.Fatal(inErr)
+	}
+	defer pf.Close()
+	if len(pf.AllHeaders()) != 7 {
+		t.Errorf("expected the chunks to be scanned, got %v", pf.AllHeaders())
+	}
+}
+
+func TestFindByTimestamp(t *testing.T) {
+	const ibdFilename = "test_time.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	if pf.FindClosestStateBeforeOrAt(9) != nil {
+		t.Errorf("there should be no state before the first one")
+	}
+	state := pf.FindClosestStateBeforeOrAt(19)
+	if state == nil || state.Timestamp() != 10 {
+		t.Errorf("expected first state, got %v", state)
+	}
+	state = pf.FindClosestStateBeforeOrAt(20)
+	if state == nil || state.Timestamp() != 20 {
+		t.Errorf("expected second state, got %v", state)
+	}
+
+	packet := pf.FindFirstPacketAtOrAfter(13)
+	if packet == nil || packet.Timestamp() != 15 {
+		t.Errorf("expected packet at 15, got %v", packet)
+	}
+	if pf.FindFirstPacketAtOrAfter(26) != nil {
+		t.Errorf("there should be no packet after the last one")
+	}
+
+	packets := pf.FindPacketsInTimeRange(12, 25)
+	if len(packets) != 2 || packets[0].Timestamp() != 12 || packets[1].Timestamp() != 15 {
+		t.Errorf("unexpected packets in range %v", packets)
+	}
+}
+
+func TestConnectionFilter(t *testing.T) {
+	const ibdFilename = "test_connections.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.DebugState([]byte("state"), 0)
+	f.DebugConnectionOpened(1, 1)
+	f.DebugConnectionOpened(2, 2)
+	f.DebugIncomingPacketOnConnection(1, []byte("from one"), 3)
+	f.DebugIncomingPacketOnConnection(2, []byte("from two"), 4)
+	f.DebugOutgoingPacketOnConnection(2, []byte("to two"), 5)
+	f.DebugConnectionClosed(1, 6)
+	reservedErr := f.DebugIncomingPacketOnConnection(NoConnectionID, []byte("no connection"), 7)
+	if reservedErr == nil {
+		t.Errorf("expected connection id %v to be rejected", NoConnectionID)
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	connectionIDs := pf.ConnectionIDs()
+	if len(connectionIDs) != 2 || connectionIDs[0] != 1 || connectionIDs[1] != 2 {
+		t.Errorf("unexpected connections %v", connectionIDs)
+	}
+	event, connectionID, eventTime, eventErr := pf.ReadConnectionEvent(8)
+	if eventErr != nil {
+		t.Fatal(eventErr)
+	}
+	if event != ConnectionClosed || connectionID != 1 || eventTime != 6 {
+		t.Errorf("unexpected connection event %v %v %v", event, connectionID, eventTime)
+	}
+
+	seq, seqErr := NewInPacketFileSequenceForConnection(pf, 2)
+	if seqErr != nil {
+		t.Fatal(seqErr)
+	}
+	defer seq.Close()
+	var payloads []string
+	for {
+		connectionID, _, _, payload, readErr := seq.ReadNextConnectionPacket()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if connectionID != 2 {
+			t.Errorf("got packet from connection %v", connectionID)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	if len(payloads) != 2 || payloads[0] != "from two" || payloads[1] != "to two" {
+		t.Errorf("unexpected packets %v", payloads)
+	}
+}
+
+func TestCaptureWithoutStates(t *testing.T) {
+	const ibdFilename = "test_without_states.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.DebugConnectionOpened(1, 0)
+	f.DebugIncomingPacketOnConnection(1, []byte("request"), 1)
+	f.DebugOutgoingPacketOnConnection(1, []byte("response"), 2)
+	f.DebugConnectionClosed(1, 3)
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	seq, seqErr := NewInPacketFileSequenceFromInFile(pf)
+	if seqErr != nil {
+		t.Fatal(seqErr)
+	}
+	defer seq.Close()
+	_, _, seekErr := seq.SeekAndGetState(0)
+	_, isStateError := seekErr.(*MissingStateError)
+	if !isStateError {
+		t.Errorf("expected missing state error when seeking, got %v", seekErr)
+	}
+	var payloads []string
+	for {
+		_, _, payload, readErr := seq.ReadNextPacket()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	if len(payloads) != 2 || payloads[0] != "request" || payloads[1] != "response" {
+		t.Errorf("unexpected packets %v", payloads)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	const ibdFilename = "test_annotations.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.DebugState([]byte("state"), 0)
+	f.DebugIncomingPacket([]byte("in"), 5)
+	annotateErr := f.Annotate(7, "picked up the flag", []byte{0x42})
+	if annotateErr != nil {
+		t.Fatal(annotateErr)
+	}
+	f.DebugIncomingPacket([]byte("after"), 9)
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+	annotations := pf.Annotations()
+	if len(annotations) != 1 || annotations[0].Timestamp() != 7 {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	time, label, data, readErr := pf.ReadAnnotation(annotations[0].PacketIndex())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if time != 7 || label != "picked up the flag" || len(data) != 1 || data[0] != 0x42 {
+		t.Errorf("unexpected annotation %v '%v' %v", time, label, data)
+	}
+
+	seq, seqErr := NewInPacketFileSequenceFromInFile(pf)
+	if seqErr != nil {
+		t.Fatal(seqErr)
+	}
+	seq.ReadNextStatePacket()
+	seq.ReadNextPacket()
+	_, _, payload, packetErr := seq.ReadNextPacket()
+	if packetErr != nil {
+		t.Fatal(packetErr)
+	}
+	if string(payload) != "after" {
+		t.Errorf("sequence should skip annotations")
+	}
+}
+
+func TestWallClockTime(t *testing.T) {
+	const ibdFilename = "test_wallclock.ibdf"
+	start := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	wallClock := start
+
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.EnableWallClockSync(1000)
+	f.now = func() time.Time { return wallClock }
+	f.DebugState([]byte("state"), 100)
+	f.DebugIncomingPacket([]byte("in"), 600)
+	// the wall clock has drifted 50ms when the next sync is written
+	wallClock = start.Add(1550 * time.Millisecond)
+	f.DebugIncomingPacket([]byte("in"), 1600)
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	startTime, startErr := pf.WallClockStartTime()
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	if !startTime.Equal(start) {
+		t.Errorf("wrong start time %v", startTime)
+	}
+	packetTime, convertErr := pf.WallClockTime(600)
+	if convertErr != nil {
+		t.Fatal(convertErr)
+	}
+	if !packetTime.Equal(start.Add(500 * time.Millisecond)) {
+		t.Errorf("wrong wall clock time %v", packetTime)
+	}
+	laterTime, laterErr := pf.WallClockTime(1700)
+	if laterErr != nil {
+		t.Fatal(laterErr)
+	}
+	if !laterTime.Equal(start.Add(1650 * time.Millisecond)) {
+		t.Errorf("should use the latest sync, got %v", laterTime)
+	}
+}
+
+func TestVerifyFindsCorruptChunk(t *testing.T) {
+	const ibdFilename = "test_verify.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{Checksums: true}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.DebugState([]byte("state"), 0)
+	f.DebugIncomingPacket([]byte("this packet will be corrupted"), 5)
+	f.DebugIncomingPacket([]byte("intact"), 9)
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	corruptOffset := pf.AllHeaders()[3].Offset() + int64(pf.AllHeaders()[3].OctetCount())
+	pf.Close()
+
+	file, fileErr := os.OpenFile(ibdFilename, os.O_RDWR, 0)
+	if fileErr != nil {
+		t.Fatal(fileErr)
+	}
+	defer file.Close()
+	_, corruptErr := file.WriteAt([]byte{'X'}, corruptOffset)
+	if corruptErr != nil {
+		t.Fatal(corruptErr)
+	}
+
+	corruptChunks, verifyErr := Verify(file)
+	if verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+	if len(corruptChunks) != 1 || corruptChunks[0].PacketIndex != 3 || corruptChunks[0].Offset != pf.AllHeaders()[3].Offset() {
+		t.Fatalf("expected chunk 3 to be corrupt, got %v", corruptChunks)
+	}
+	var checksumErr *ChecksumError
+	if !errors.As(corruptChunks[0].Err, &checksumErr) {
+		t.Errorf("expected a checksum error, got %v", corruptChunks[0].Err)
+	}
+}
+
+func TestTolerantOpenOfTruncatedFile(t *testing.T) {
+	const ibdFilename = "test_truncated.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	lastPacketOffset := pf.AllHeaders()[6].Offset()
+	pf.Close()
+
+	intact, intactReport, intactErr := NewInPacketFileTolerant(ibdFilename)
+	if intactErr != nil {
+		t.Fatal(intactErr)
+	}
+	intact.Close()
+	if intactReport.ChunkCount != 8 || intactReport.DiscardedOctetCount != 0 {
+		t.Errorf("expected all chunks, including the index, of an intact file %v", intactReport)
+	}
+
+	truncateErr := os.Truncate(ibdFilename, lastPacketOffset+5)
+	if truncateErr != nil {
+		t.Fatal(truncateErr)
+	}
+	_, strictErr := NewInPacketFile(ibdFilename)
+	if strictErr == nil {
+		t.Fatal("expected truncated file to be rejected")
+	}
+
+	recovered, report, recoverErr := NewInPacketFileTolerant(ibdFilename)
+	if recoverErr != nil {
+		t.Fatal(recoverErr)
+	}
+	defer recovered.Close()
+	if len(recovered.AllHeaders()) != 6 || report.ChunkCount != 6 {
+		t.Errorf("expected six complete chunks, got %v %v", recovered.AllHeaders(), report)
+	}
+	if report.RecoveredOctetCount != lastPacketOffset || report.DiscardedOctetCount != 5 {
+		t.Errorf("wrong recovery report %v", report)
+	}
+	_, _, state, stateErr := recovered.ReadStatePacket(5)
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if string(state) != "second state" {
+		t.Errorf("wrong state %v", state)
+	}
+
+	const payloadFilename = "test_truncated_payload.ibdf"
+	writeTestFile(t, payloadFilename)
+	truncateErr = os.Truncate(payloadFilename, lastPacketOffset+piffChunkHeaderOctetCount+11)
+	if truncateErr != nil {
+		t.Fatal(truncateErr)
+	}
+	payloadRecovered, payloadReport, payloadErr := NewInPacketFileTolerant(payloadFilename)
+	if payloadErr != nil {
+		t.Fatal(payloadErr)
+	}
+	defer payloadRecovered.Close()
+	if len(payloadRecovered.AllHeaders()) != 6 || payloadReport.ChunkCount != 6 {
+		t.Errorf("expected six complete chunks when the last payload is cut short, got %v", payloadReport)
+	}
+	if payloadReport.RecoveredOctetCount != lastPacketOffset || payloadReport.DiscardedOctetCount != piffChunkHeaderOctetCount+11 {
+		t.Errorf("wrong recovery report for a cut short payload %v", payloadReport)
+	}
+}
+
+func TestConcurrentSequences(t *testing.T) {
+	const ibdFilename = "test_concurrent.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewConcurrentInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	const readerCount = 8
+	results := make(chan error, readerCount)
+	for i := 0; i < readerCount; i++ {
+		go func() {
+			sequence, sequenceErr := NewInPacketFileSequenceFromInFile(pf)
+			if sequenceErr != nil {
+				results <- sequenceErr
+				return
+			}
+			defer sequence.Close()
+			var payloads []string
+			for {
+				_, _, payload, readErr := sequence.ReadNextPacket()
+				if readErr == io.EOF {
+					break
+				}
+				if readErr != nil {
+					results <- readErr
+					return
+				}
+				payloads = append(payloads, string(payload))
+			}
+			if len(payloads) != 3 || payloads[0] != "in" || payloads[1] != "out" || payloads[2] != "last" {
+				results <- fmt.Errorf("wrong packets %v", payloads)
+				return
+			}
+			results <- nil
+		}()
+	}
+	for i := 0; i < readerCount; i++ {
+		readErr := <-results
+		if readErr != nil {
+			t.Error(readErr)
+		}
+	}
+}
+
+func TestSequencePositioning(t *testing.T) {
+	const ibdFilename = "test_positioning.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+	sequence, sequenceErr := NewInPacketFileSequenceFromInFile(pf)
+	if sequenceErr != nil {
+		t.Fatal(sequenceErr)
+	}
+
+	state, packets, seekErr := sequence.SeekToTime(16)
+	if seekErr != nil {
+		t.Fatal(seekErr)
+	}
+	if state.Timestamp() != 10 || string(state.Payload()) != "first state" {
+		t.Errorf("wrong state %v", state)
+	}
+	if len(packets) != 2 || string(packets[0].Payload()) != "in" || packets[1].PacketDirection() != CmdOutgoingPacket {
+		t.Errorf("wrong packets after state %v", packets)
+	}
+	peeked, peekErr := sequence.Peek()
+	if peekErr != nil {
+		t.Fatal(peekErr)
+	}
+	if peeked.Type() != RecordTypeState || peeked.Timestamp() != 20 || sequence.Cursor() != 5 {
+		t.Errorf("peek should return the next state without moving the cursor %v %v", peeked, sequence.Cursor())
+	}
+
+	_, packets, seekErr = sequence.SeekToTime(24)
+	if seekErr != nil {
+		t.Fatal(seekErr)
+	}
+	if len(packets) != 0 {
+		t.Errorf("expected no packets between state and time %v", packets)
+	}
+	_, _, payload, readErr := sequence.ReadNextPacket()
+	if readErr != nil || string(payload) != "last" {
+		t.Fatalf("wrong packet %v %v", payload, readErr)
+	}
+
+	stepErr := sequence.StepBack()
+	if stepErr != nil {
+		t.Fatal(stepErr)
+	}
+	_, _, payload, readErr = sequence.ReadNextPacket()
+	if readErr != nil || string(payload) != "last" {
+		t.Fatalf("step back should return the same packet again %v %v", payload, readErr)
+	}
+	sequence.StepBack()
+	sequence.StepBack()
+	_, statePayload, stateErr := sequence.ReadNextStatePacket()
+	if stateErr != nil || string(statePayload) != "second state" {
+		t.Fatalf("wrong state %v %v", statePayload, stateErr)
+	}
+
+	positionErr := sequence.SeekToPacketIndex(3)
+	if positionErr != nil {
+		t.Fatal(positionErr)
+	}
+	_, _, payload, readErr = sequence.ReadNextPacket()
+	if readErr != nil || string(payload) != "in" {
+		t.Fatalf("wrong packet %v %v", payload, readErr)
+	}
+	if sequence.SeekToPacketIndex(100) == nil {
+		t.Errorf("expected out of range packet index to fail")
+	}
+	sequence.SeekToPacketIndex(2)
+	if sequence.StepBack() == nil {
+		t.Errorf("expected step back from the first packet to fail")
+	}
+}
@@ -27,14 +27,21 @@ SOFTWARE.
 package ibdf
 
 import (
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/piot/brook-go/src/instream"
 	"github.com/piot/piff-go/src/piff"
 )
 
 type InStream struct {
-	stream *piff.InStream
+	stream              *piff.InStream
+	checksums           bool
+	keyframe            []byte
+	keyframePacketIndex PacketIndex
+	hasKeyframe         bool
+	follower            *FollowReader
 }
 
 func NewInPacketStream(reader io.Reader) (*InStream, error) {
@@ -47,6 +54,24 @@ func NewInPacketStream(reader io.Reader) (*InStream, error) {
 	return &InStream{stream: stream}, nil
 }
 
+// NewInPacketStreamFollow creates a stream for a capture that is still being written. Instead of reaching the end,
+// the reads wait for more chunks until StopFollowing is called.
+func NewInPacketStreamFollow(reader io.Reader, pollInterval time.Duration) (*InStream, error) {
+	follower := NewFollowReader(reader, pollInterval)
+	stream, err := NewInPacketStream(follower)
+	if err != nil {
+		return nil, err
+	}
+	stream.follower = follower
+	return stream, nil
+}
+
+func (i *InStream) StopFollowing() {
+	if i.follower != nil {
+		i.follower.Stop()
+	}
+}
+
 func (i *InStream) IsNextSchema() bool {
 	piffHeader := i.stream.PendingChunkHeader()
 	return piffHeader.TypeIDString() == "sch1"
@@ -54,12 +79,24 @@ func (i *InStream) IsNextSchema() bool {
 
 func (i *InStream) IsNextState() bool {
 	piffHeader := i.stream.PendingChunkHeader()
-	return piffHeader.TypeIDString() == "sta1"
+	typeID := uncompressedTypeID(piffHeader.TypeIDString())
+	return typeID == "sta1" || typeID == "std1"
 }
 
 func (i *InStream) IsNextPacket() bool {
 	piffHeader := i.stream.PendingChunkHeader()
-	return piffHeader.TypeIDString() == "pkt1"
+	typeID := uncompressedTypeID(piffHeader.TypeIDString())
+	return typeID == "pkt1" || typeID == "pkt2"
+}
+
+func (i *InStream) IsNextConnectionEvent() bool {
+	piffHeader := i.stream.PendingChunkHeader()
+	return piffHeader.TypeIDString() == "con1"
+}
+
+func (i *InStream) IsNextAnnotation() bool {
+	piffHeader := i.stream.PendingChunkHeader()
+	return piffHeader.TypeIDString() == "ann1"
 }
 
 func (i *InStream) IsNextFileHeader() bool {
@@ -67,12 +104,106 @@ func (i *InStream) IsNextFileHeader() bool {
 	return piffHeader.TypeIDString() == "pac1"
 }
 
+func (i *InStream) IsNextIndex() bool {
+	piffHeader := i.stream.PendingChunkHeader()
+	return piffHeader.TypeIDString() == "idx1"
+}
+
+func (i *InStream) readChunk() (piff.InHeader, []byte, error) {
+	// The index is always the last chunk, so there is nothing more to wait for after it.
+	if i.IsNextIndex() {
+		i.StopFollowing()
+	}
+	header, payload, readErr := i.stream.ReadChunk()
+	if readErr != nil {
+		return header, nil, readErr
+	}
+	octets, checksumErr := stripChecksum(i.checksums, header, payload)
+	if checksumErr != nil {
+		return header, nil, checksumErr
+	}
+	return header, octets, nil
+}
+
 func (i *InStream) ReadNextPacket() (piff.ChunkIndex, PacketDirection, uint64, []byte, error) {
-	return deserializePacketFromStream(i.stream)
+	chunkIndex, _, direction, time, payload, readErr := i.ReadNextConnectionPacket()
+	return chunkIndex, direction, time, payload, readErr
+}
+
+func (i *InStream) ReadNextConnectionPacket() (piff.ChunkIndex, ConnectionID, PacketDirection, uint64, []byte, error) {
+	header, payload, readErr := i.readChunk()
+	if readErr != nil {
+		return 0, 0, 0, 0, nil, readErr
+	}
+	chunkIndex, connectionID, direction, time, octets, deserializeErr := deserializeConnectionPacketFromPiffPayload(header, payload)
+	if deserializeErr != nil {
+		return 0, 0, 0, 0, nil, deserializeErr
+	}
+	decompressed, decompressErr := decompressOctets(header, octets)
+	if decompressErr != nil {
+		return 0, 0, 0, 0, nil, decompressErr
+	}
+	return chunkIndex, connectionID, direction, time, decompressed, nil
+}
+
+func (i *InStream) ReadNextConnectionEvent() (ConnectionEvent, ConnectionID, uint64, error) {
+	header, payload, readErr := i.readChunk()
+	if readErr != nil {
+		return 0, 0, 0, readErr
+	}
+	return deserializeConnectionEvent(header, payload)
+}
+
+func (i *InStream) ReadNextAnnotation() (uint64, string, []byte, error) {
+	header, payload, readErr := i.readChunk()
+	if readErr != nil {
+		return 0, "", nil, readErr
+	}
+	return deserializeAnnotationFromPiffPayload(header, payload)
 }
 
 func (i *InStream) ReadNextStatePacket() (piff.ChunkIndex, uint64, []byte, error) {
-	return deserializeStatePacketFromStream(i.stream)
+	header, payload, readErr := i.readChunk()
+	if readErr != nil {
+		return 0, 0, nil, readErr
+	}
+	return i.readState(header, payload)
+}
+
+// readState returns the complete state, also for deltas. Deltas can only be applied to the most recent keyframe,
+// which is always the case for files written by OutPacketFile.
+func (i *InStream) readState(header piff.InHeader, payload []byte) (piff.ChunkIndex, uint64, []byte, error) {
+	if uncompressedTypeID(header.TypeIDString()) == "std1" {
+		chunkIndex, time, keyframePacketIndex, compressedDiff, deserializeErr := deserializeStateDeltaFromPiffPayload(header, payload)
+		if deserializeErr != nil {
+			return 0, 0, nil, deserializeErr
+		}
+		if !i.hasKeyframe || keyframePacketIndex != i.keyframePacketIndex {
+			return 0, 0, nil, fmt.Errorf("state delta (%v) refers to keyframe %v that is not the most recent keyframe", chunkIndex, keyframePacketIndex)
+		}
+		diff, decompressErr := decompressOctets(header, compressedDiff)
+		if decompressErr != nil {
+			return 0, 0, nil, decompressErr
+		}
+		state, applyErr := applyDiff(header, i.keyframe, diff)
+		if applyErr != nil {
+			return 0, 0, nil, applyErr
+		}
+		return chunkIndex, time, state, nil
+	}
+
+	chunkIndex, time, octets, deserializeErr := deserializeStatePacketFromPiffPayload(header, payload)
+	if deserializeErr != nil {
+		return 0, 0, nil, deserializeErr
+	}
+	state, decompressErr := decompressOctets(header, octets)
+	if decompressErr != nil {
+		return 0, 0, nil, decompressErr
+	}
+	i.keyframe = state
+	i.keyframePacketIndex = PacketIndex(chunkIndex)
+	i.hasKeyframe = true
+	return chunkIndex, time, state, nil
 }
 
 func (i *InStream) ReadNextSchemaTextPacket() (string, error) {
@@ -80,12 +211,104 @@ func (i *InStream) ReadNextSchemaTextPacket() (string, error) {
 }
 
 func (i *InStream) ReadNextFileHeader() (Header, error) {
-	_, payload, err := i.stream.ReadChunk()
+	_, payload, err := i.readChunk()
 	if err != nil {
 		return Header{}, err
 	}
+	return i.readFileHeader(payload)
+}
+
+func (i *InStream) readFileHeader(payload []byte) (Header, error) {
 	stream := instream.New(payload)
-	return readHeader(stream)
+	header, headerErr := readHeader(stream, len(payload))
+	if headerErr != nil {
+		return Header{}, headerErr
+	}
+	i.checksums = header.Checksums
+	return header, nil
+}
+
+func (i *InStream) ReadNextIndex() ([]*HeaderInfo, error) {
+	header, payload, err := i.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	return deserializeIndex(header, payload)
+}
+
+func (i *InStream) Next() (Record, error) {
+	if i.stream.IsEOF() {
+		return Record{}, io.EOF
+	}
+	header, payload, readErr := i.readChunk()
+	if readErr != nil {
+		return Record{}, readErr
+	}
+	record := Record{typeID: header.TypeIDString(), chunkIndex: header.ChunkIndex(), payload: payload}
+	switch uncompressedTypeID(record.typeID) {
+	case "pac1":
+		record.recordType = RecordTypeFileHeader
+		fileHeader, headerErr := i.readFileHeader(payload)
+		if headerErr != nil {
+			return Record{}, headerErr
+		}
+		record.fileHeader = fileHeader
+	case "sch1":
+		record.recordType = RecordTypeSchema
+	case "sta1", "std1":
+		record.recordType = RecordTypeState
+		_, time, statePayload, stateErr := i.readState(header, payload)
+		if stateErr != nil {
+			return Record{}, stateErr
+		}
+		record.timestamp = time
+		record.payload = statePayload
+	case "pkt1", "pkt2":
+		record.recordType = RecordTypePacket
+		_, connectionID, direction, time, packetPayload, packetErr := deserializeConnectionPacketFromPiffPayload(header, payload)
+		if packetErr != nil {
+			return Record{}, packetErr
+		}
+		record.connectionID = connectionID
+		record.direction = direction
+		record.timestamp = time
+		record.payload, packetErr = decompressOctets(header, packetPayload)
+		if packetErr != nil {
+			return Record{}, packetErr
+		}
+	case "con1":
+		record.recordType = RecordTypeConnectionEvent
+		event, connectionID, time, eventErr := deserializeConnectionEvent(header, payload)
+		if eventErr != nil {
+			return Record{}, eventErr
+		}
+		record.connectionEvent = event
+		record.connectionID = connectionID
+		record.timestamp = time
+	case "ann1":
+		record.recordType = RecordTypeAnnotation
+		time, label, data, annotationErr := deserializeAnnotationFromPiffPayload(header, payload)
+		if annotationErr != nil {
+			return Record{}, annotationErr
+		}
+		record.timestamp = time
+		record.label = label
+		record.payload = data
+	case "clk1":
+		record.recordType = RecordTypeClockSync
+		time, wallClock, clockErr := deserializeClockSync(header, payload)
+		if clockErr != nil {
+			return Record{}, clockErr
+		}
+		record.timestamp = time
+		record.wallClock = wallClock
+	case "idx1":
+		record.recordType = RecordTypeIndex
+	default:
+		record.recordType = RecordTypeUnknown
+	}
+
+	return record, nil
 }
 
 func (i *InStream) IsEOF() bool {
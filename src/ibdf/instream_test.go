@@ -0,0 +1,237 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNextRecord(t *testing.T) {
+	const ibdFilename = "test_stream.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	file, openErr := os.Open(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+
+	inStream, streamErr := NewInPacketStream(file)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+
+	expectedTypes := []RecordType{RecordTypeFileHeader, RecordTypeSchema, RecordTypeState, RecordTypePacket,
+		RecordTypePacket, RecordTypeState, RecordTypePacket, RecordTypeIndex}
+	var records []Record
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != len(expectedTypes) {
+		t.Fatalf("expected %v records, got %v", len(expectedTypes), len(records))
+	}
+	for index, record := range records {
+		if record.Type() != expectedTypes[index] {
+			t.Errorf("record %v: expected %v but got %v", index, expectedTypes[index], record.Type())
+		}
+	}
+
+	if records[0].FileHeader().CompanyName != "SomeCompany" {
+		t.Errorf("wrong header %v", records[0].FileHeader())
+	}
+	packet := records[4]
+	if packet.PacketDirection() != CmdOutgoingPacket || packet.Timestamp() != 15 || string(packet.Payload()) != "out" {
+		t.Errorf("wrong packet %v", packet)
+	}
+}
+
+func TestOutPacketWriter(t *testing.T) {
+	var buf bytes.Buffer
+	f, outErr := NewOutPacketWriter(&buf, Header{CompanyName: "SomeCompany"}, []byte("schema"))
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	writeErr := f.DebugState([]byte("state"), 10)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("in"), 12)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	f.Close()
+
+	inStream, streamErr := NewInPacketStream(&buf)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	header, headerErr := inStream.ReadNextFileHeader()
+	if headerErr != nil {
+		t.Fatal(headerErr)
+	}
+	if header.CompanyName != "SomeCompany" {
+		t.Errorf("wrong header %v", header)
+	}
+	schema, schemaErr := inStream.ReadNextSchemaTextPacket()
+	if schemaErr != nil {
+		t.Fatal(schemaErr)
+	}
+	if schema != "schema" {
+		t.Errorf("wrong schema %v", schema)
+	}
+	_, stateTime, _, stateErr := inStream.ReadNextStatePacket()
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if stateTime != 10 {
+		t.Errorf("wrong state time %v", stateTime)
+	}
+	_, direction, packetTime, payload, packetErr := inStream.ReadNextPacket()
+	if packetErr != nil {
+		t.Fatal(packetErr)
+	}
+	if direction != CmdIncomingPacket || packetTime != 12 || string(payload) != "in" {
+		t.Errorf("wrong packet %v %v %v", direction, packetTime, payload)
+	}
+}
+
+func TestTruncatedChunkReturnsCorruptChunkError(t *testing.T) {
+	const ibdFilename = "test_truncated_chunk.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	truncatedErr := f.outFile.WriteChunkTypeIDString("pkt1", []byte{CmdIncomingPacket, 0})
+	if truncatedErr != nil {
+		t.Fatal(truncatedErr)
+	}
+	f.Close()
+
+	file, openErr := os.Open(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+	inStream, streamErr := NewInPacketStream(file)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr == io.EOF {
+			t.Fatal("expected the truncated packet to be reported")
+		}
+		if nextErr != nil {
+			var corruptErr *CorruptChunkError
+			if !errors.As(nextErr, &corruptErr) {
+				t.Fatalf("expected a corrupt chunk error, got %v", nextErr)
+			}
+			if corruptErr.TypeID != "pkt1" || corruptErr.ExpectedOctetCount != pktHeaderOctetCount || corruptErr.ActualOctetCount != 2 {
+				t.Errorf("wrong corrupt chunk error %v", corruptErr)
+			}
+			return
+		}
+		if record.Type() == RecordTypePacket {
+			t.Fatalf("truncated packet was accepted %v", record)
+		}
+	}
+}
+
+func TestFollowWaitsForMoreChunks(t *testing.T) {
+	const completeFilename = "test_follow_complete.ibdf"
+	const ibdFilename = "test_follow.ibdf"
+	writeTestFile(t, completeFilename)
+	octets, readErr := ioutil.ReadFile(completeFilename)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	half := len(octets) / 2
+	writeErr := ioutil.WriteFile(ibdFilename, octets[:half], 0644)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	file, openErr := os.Open(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+	inStream, streamErr := NewInPacketStreamFollow(file, time.Millisecond)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+
+	appendDone := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		appendFile, appendErr := os.OpenFile(ibdFilename, os.O_WRONLY|os.O_APPEND, 0)
+		if appendErr != nil {
+			appendDone <- appendErr
+			return
+		}
+		_, appendErr = appendFile.Write(octets[half:])
+		appendFile.Close()
+		appendDone <- appendErr
+	}()
+
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		if record.Type() == RecordTypePacket && record.Timestamp() == 25 {
+			break
+		}
+	}
+	appendErr := <-appendDone
+	if appendErr != nil {
+		t.Fatal(appendErr)
+	}
+
+	record, nextErr := inStream.Next()
+	if nextErr != nil || record.Type() != RecordTypeIndex {
+		t.Fatalf("expected index, got %v %v", record.Type(), nextErr)
+	}
+	_, nextErr = inStream.Next()
+	if nextErr != io.EOF {
+		t.Errorf("expected EOF after the index, got %v", nextErr)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+// mappedChunks returns chunk payloads as slices of octets that are already in memory, e.g. a memory mapped file.
+// piff is only used to scan the headers, the payloads are found from the chunk offsets. Nothing is modified after
+// creation, so chunks can be found from several goroutines at the same time.
+type mappedChunks struct {
+	octets  []byte
+	inFile  *piff.InSeeker
+	offsets []int64
+}
+
+func newMappedChunks(octets []byte) (*mappedChunks, error) {
+	inFile, err := piff.NewInSeeker(bytes.NewReader(octets))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedChunks{octets: octets, inFile: inFile, offsets: chunkOffsets(inFile.AllHeaders())}, nil
+}
+
+func (m *mappedChunks) findChunk(chunkIndex int) (piff.InHeader, []byte, error) {
+	allHeaders := m.inFile.AllHeaders()
+	if chunkIndex < 0 || chunkIndex >= len(allHeaders) {
+		var header piff.InHeader
+		return header, nil, fmt.Errorf("chunk %v is not in the file", chunkIndex)
+	}
+	header := allHeaders[chunkIndex].Header()
+	payloadStart := m.offsets[chunkIndex] + piffChunkHeaderOctetCount
+	payloadEnd := payloadStart + int64(header.OctetCount())
+	if payloadEnd > int64(len(m.octets)) {
+		return header, nil, fmt.Errorf("chunk %v ends after the mapped octets", chunkIndex)
+	}
+	return header, m.octets[payloadStart:payloadEnd:payloadEnd], nil
+}
@@ -0,0 +1,90 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+const maxInt = int(^uint(0) >> 1)
+
+type memoryMapping struct {
+	octets []byte
+}
+
+func (m *memoryMapping) Close() error {
+	return syscall.Munmap(m.octets)
+}
+
+// NewMappedInPacketFile memory maps the file, so ReadPacket, ReadConnectionPacket and ReadStatePacket can return
+// slices of the mapped file instead of copies.
+//
+// The returned slices are only valid until Close is called, and must never be modified since the mapping is read only.
+// Copy the octets if they are needed after Close. Compressed packets and delta states are always returned as new slices.
+// Chunks can be read from several goroutines at the same time, with one sequence per goroutine. Closing a sequence
+// does not close the shared file.
+func NewMappedInPacketFile(filename string) (*InPacketFile, error) {
+	file, openErr := os.Open(path.Clean(filename))
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+	if stat.Size() == 0 {
+		return nil, fmt.Errorf("can not map empty file %v", filename)
+	}
+	if stat.Size() > int64(maxInt) {
+		return nil, fmt.Errorf("file %v is too large to map", filename)
+	}
+	octets, mapErr := syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if mapErr != nil {
+		return nil, mapErr
+	}
+	mapping := &memoryMapping{octets: octets}
+
+	chunks, chunksErr := newMappedChunks(octets)
+	if chunksErr != nil {
+		mapping.Close()
+		return nil, chunksErr
+	}
+	c, err := newInPacketFile(chunks.inFile)
+	if err != nil {
+		mapping.Close()
+		return nil, err
+	}
+	c.mapped = chunks
+	c.closer = mapping
+
+	return c, nil
+}
@@ -0,0 +1,108 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"testing"
+)
+
+func TestMappedReadPacket(t *testing.T) {
+	const ibdFilename = "test_mapped.ibdf"
+	writeTestFile(t, ibdFilename)
+
+	pf, openErr := NewMappedInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	_, direction, time, payload, readErr := pf.ReadPacket(4)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if direction != CmdOutgoingPacket || time != 15 || string(payload) != "out" {
+		t.Errorf("wrong packet %v %v %v", direction, time, payload)
+	}
+	_, stateTime, state, stateErr := pf.ReadStatePacket(5)
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if stateTime != 20 || string(state) != "second state" {
+		t.Errorf("wrong state %v %v", stateTime, state)
+	}
+}
+
+const benchmarkFilename = "benchmark.ibdf"
+
+func writeBenchmarkFile(b *testing.B) {
+	f, outErr := NewOutPacketFile(benchmarkFilename, Header{}, nil)
+	if outErr != nil {
+		b.Fatal(outErr)
+	}
+	payload := make([]byte, 1200)
+	f.DebugState(payload, 0)
+	for i := 0; i < 10000; i++ {
+		f.DebugIncomingPacket(payload, int64(i))
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		b.Fatal(closeErr)
+	}
+}
+
+func benchmarkReadPackets(b *testing.B, pf *InPacketFile) {
+	packetCount := len(pf.AllHeaders())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packetIndex := PacketIndex(3 + i%(packetCount-3))
+		_, _, _, _, readErr := pf.ReadPacket(packetIndex)
+		if readErr != nil {
+			b.Fatal(readErr)
+		}
+	}
+}
+
+func BenchmarkReadPacketSeeker(b *testing.B) {
+	writeBenchmarkFile(b)
+	pf, openErr := NewInPacketFile(benchmarkFilename)
+	if openErr != nil {
+		b.Fatal(openErr)
+	}
+	defer pf.Close()
+	benchmarkReadPackets(b, pf)
+}
+
+func BenchmarkReadPacketMapped(b *testing.B) {
+	writeBenchmarkFile(b)
+	pf, openErr := NewMappedInPacketFile(benchmarkFilename)
+	if openErr != nil {
+		b.Fatal(openErr)
+	}
+	defer pf.Close()
+	benchmarkReadPackets(b, pf)
+}
@@ -27,7 +27,12 @@ SOFTWARE.
 package ibdf
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path"
+	"time"
 
 	"github.com/piot/brook-go/src/outstream"
 	"github.com/piot/piff-go/src/piff"
@@ -41,15 +46,41 @@ const (
 )
 
 type OutPacketFile struct {
-	outFile *piff.OutStream
+	outFile    *piff.OutStream
+	file       *os.File
+	forwarder  *chunkForwarder
+	chunkCount PacketIndex
+	index      *outstream.OutStream
+	compressor *compressor
+	checksums  bool
+	err        error
+
+	keyframeInterval    int
+	statesSinceKeyframe int
+	keyframe            []byte
+	keyframePacketIndex PacketIndex
+	hasKeyframe         bool
+
+	wallClockSyncIntervalMs int64
+	lastWallClockSyncMs     int64
+	hasWallClockSync        bool
+	now                     func() time.Time
+
+	closed   bool
+	closeErr error
 }
 
 func NewOutPacketFile(filename string, header Header, schemaPayload []byte) (*OutPacketFile, error) {
-	newPiffFile, err := piff.NewOutStream(filename)
+	file, createErr := os.Create(path.Clean(filename))
+	if createErr != nil {
+		return nil, createErr
+	}
+	c, err := NewOutPacketFileUsingFile(file, header, schemaPayload)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
-	return internalCreate(newPiffFile, header, schemaPayload)
+	return c, nil
 }
 
 func NewOutPacketFileUsingFile(file *os.File, header Header, schemaPayload []byte) (*OutPacketFile, error) {
@@ -58,7 +89,7 @@ func NewOutPacketFileUsingFile(file *os.File, header Header, schemaPayload []byt
 		return nil, err
 	}
 
-	return internalCreate(newPiffFile, header, schemaPayload)
+	return internalCreate(newPiffFile, file, header, schemaPayload)
 }
 
 func writeString(out *outstream.OutStream, s string) error {
@@ -107,34 +138,151 @@ func writeHeader(headerStream *outstream.OutStream, header Header) error {
 	}
 
 	protocolErr := writeNameAndVersion(headerStream, header.Protocol)
-	return protocolErr
+	if protocolErr != nil {
+		return protocolErr
+	}
+
+	if header.Compression == CompressionNone && !header.Checksums {
+		return nil
+	}
+	compressionErr := headerStream.WriteUint8(uint8(header.Compression))
+	if compressionErr != nil {
+		return compressionErr
+	}
+
+	if !header.Checksums {
+		return nil
+	}
+	return headerStream.WriteUint8(headerFlagChecksums)
 }
 
-func internalCreate(newPiffFile *piff.OutStream, header Header, schemaPayload []byte) (*OutPacketFile, error) {
+func internalCreate(newPiffFile *piff.OutStream, file *os.File, header Header, schemaPayload []byte) (*OutPacketFile, error) {
 	c := &OutPacketFile{
 		outFile: newPiffFile,
+		file:    file,
+	}
+
+	startErr := c.writeStart(header, schemaPayload)
+	if startErr != nil {
+		return nil, startErr
+	}
+	return c, nil
+}
+
+func (c *OutPacketFile) writeStart(header Header, schemaPayload []byte) error {
+	c.index = outstream.New()
+	newCompressor, compressionErr := newCompressor(header.Compression)
+	if compressionErr != nil {
+		return compressionErr
 	}
+	c.compressor = newCompressor
+	c.checksums = header.Checksums
 
 	headerStream := outstream.New()
 	headerErr := writeHeader(headerStream, header)
 	if headerErr != nil {
-		return nil, headerErr
+		return headerErr
+	}
+	_, headerWriteErr := c.writeChunk("pac1", HeaderInfo{packetType: PacketTypeOther, direction: CmdIncomingPacket}, headerStream.Octets())
+	if headerWriteErr != nil {
+		return headerWriteErr
+	}
+
+	_, writeErr := c.writeChunk("sch1", HeaderInfo{packetType: PacketTypeOther, direction: CmdIncomingPacket}, schemaPayload)
+	return writeErr
+}
+
+func (c *OutPacketFile) currentOffset() int64 {
+	if c.forwarder != nil {
+		return c.forwarder.forwardedOctetCount
+	}
+	if c.file == nil {
+		return -1
+	}
+	offset, seekErr := c.file.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		return -1
+	}
+	return offset
+}
+
+// checkErr returns the first error encountered. Once an error has occurred, the file is considered broken and
+// nothing more is written.
+func (c *OutPacketFile) checkErr() error {
+	return c.err
+}
+
+// writeChunk writes the chunk and adds info to the index. The packet index, offset and octet count are set by writeChunk.
+// The returned packet index is the one assigned to the chunk, which is not the chunk count before the call if a clock
+// sync was written first.
+func (c *OutPacketFile) writeChunk(typeID string, info HeaderInfo, payload []byte) (PacketIndex, error) {
+	previousErr := c.checkErr()
+	if previousErr != nil {
+		return 0, previousErr
+	}
+	if info.packetType == PacketTypeState || info.packetType == PacketTypeNormal {
+		syncErr := c.syncWallClockIfNeeded(info.timestamp)
+		if syncErr != nil {
+			return 0, syncErr
+		}
+	}
+	if c.checksums && isChecksummedTypeID(typeID) {
+		payload = appendChecksum(payload)
+	}
+	info.packetIndex = c.chunkCount
+	info.offset = c.currentOffset()
+	info.octetCount = len(payload)
+	writeErr := c.outFile.WriteChunkTypeIDString(typeID, payload)
+	if writeErr != nil {
+		c.err = writeErr
+		return 0, writeErr
+	}
+	if c.forwarder != nil {
+		forwardErr := c.forwarder.forward()
+		if forwardErr != nil {
+			c.err = forwardErr
+			return 0, forwardErr
+		}
+	}
+	c.chunkCount++
+	indexErr := serializeIndexEntry(c.index, info)
+	if indexErr != nil {
+		c.err = indexErr
+		return 0, indexErr
 	}
-	c.outFile.WriteChunkTypeIDString("pac1", headerStream.Octets())
+	return info.packetIndex, nil
+}
 
-	writeErr := c.outFile.WriteChunkTypeIDString("sch1", schemaPayload)
+func (c *OutPacketFile) writeIndex() error {
+	previousErr := c.checkErr()
+	if previousErr != nil {
+		return previousErr
+	}
+	payload, serializeErr := serializeIndex(int(c.chunkCount), c.index.Octets())
+	if serializeErr != nil {
+		return serializeErr
+	}
+	writeErr := c.outFile.WriteChunkTypeIDString("idx1", payload)
 	if writeErr != nil {
-		return nil, writeErr
+		return writeErr
 	}
-	return c, nil
+	if c.forwarder != nil {
+		return c.forwarder.forward()
+	}
+	return nil
 }
 
 func (c *OutPacketFile) writePacket(cmd PacketDirection, monotonicTimeMs int64, b []byte) error {
-	s := outstream.New()
-	s.WriteUint8(cmd)
-	s.WriteUint64(uint64(monotonicTimeMs))
-	s.WriteOctets(b)
-	return c.outFile.WriteChunkTypeIDString("pkt1", s.Octets())
+	compressed, compressErr := c.compressor.compress(b)
+	if compressErr != nil {
+		return compressErr
+	}
+	payload, serializeErr := serializePacket(cmd, monotonicTimeMs, compressed)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk(c.compressor.typeID("pkt1"), HeaderInfo{packetType: PacketTypeNormal, direction: cmd, timestamp: monotonicTimeMs}, payload)
+	return writeErr
 }
 
 func (c *OutPacketFile) DebugIncomingPacket(b []byte, monotonicTimeMs int64) error {
@@ -145,13 +293,215 @@ func (c *OutPacketFile) DebugOutgoingPacket(b []byte, monotonicTimeMs int64) err
 	return c.writePacket(CmdOutgoingPacket, monotonicTimeMs, b)
 }
 
+func (c *OutPacketFile) writeConnectionPacket(cmd PacketDirection, connectionID ConnectionID, monotonicTimeMs int64, b []byte) error {
+	if connectionID == NoConnectionID {
+		return fmt.Errorf("connection id %v is reserved for packets without a connection", NoConnectionID)
+	}
+	compressed, compressErr := c.compressor.compress(b)
+	if compressErr != nil {
+		return compressErr
+	}
+	payload, serializeErr := serializeConnectionPacket(cmd, connectionID, monotonicTimeMs, compressed)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk(c.compressor.typeID("pkt2"), HeaderInfo{packetType: PacketTypeNormal, direction: cmd, connectionID: connectionID, timestamp: monotonicTimeMs}, payload)
+	return writeErr
+}
+
+func (c *OutPacketFile) DebugIncomingPacketOnConnection(connectionID ConnectionID, b []byte, monotonicTimeMs int64) error {
+	return c.writeConnectionPacket(CmdIncomingPacket, connectionID, monotonicTimeMs, b)
+}
+
+func (c *OutPacketFile) DebugOutgoingPacketOnConnection(connectionID ConnectionID, b []byte, monotonicTimeMs int64) error {
+	return c.writeConnectionPacket(CmdOutgoingPacket, connectionID, monotonicTimeMs, b)
+}
+
+func (c *OutPacketFile) writeConnectionEvent(event ConnectionEvent, connectionID ConnectionID, monotonicTimeMs int64) error {
+	if connectionID == NoConnectionID {
+		return fmt.Errorf("connection id %v is reserved for packets without a connection", NoConnectionID)
+	}
+	payload, serializeErr := serializeConnectionEvent(event, connectionID, monotonicTimeMs)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk("con1", HeaderInfo{packetType: PacketTypeConnectionEvent, direction: CmdIncomingPacket, connectionID: connectionID, timestamp: monotonicTimeMs}, payload)
+	return writeErr
+}
+
+func (c *OutPacketFile) DebugConnectionOpened(connectionID ConnectionID, monotonicTimeMs int64) error {
+	return c.writeConnectionEvent(ConnectionOpened, connectionID, monotonicTimeMs)
+}
+
+func (c *OutPacketFile) DebugConnectionClosed(connectionID ConnectionID, monotonicTimeMs int64) error {
+	return c.writeConnectionEvent(ConnectionClosed, connectionID, monotonicTimeMs)
+}
+
+// EnableStateDeltas makes DebugState store the difference to the previous full state (keyframe), instead of the
+// complete state. A new keyframe is written every keyframeInterval states, or when the delta isn't smaller than the state.
+func (c *OutPacketFile) EnableStateDeltas(keyframeInterval int) {
+	c.keyframeInterval = keyframeInterval
+}
+
+func (c *OutPacketFile) writeStateKeyframe(stateOctets []byte, monotonicTimeMs int64) error {
+	compressed, compressErr := c.compressor.compress(stateOctets)
+	if compressErr != nil {
+		return compressErr
+	}
+	payload, serializeErr := serializeStatePacket(monotonicTimeMs, compressed)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	packetIndex, writeErr := c.writeChunk(c.compressor.typeID("sta1"), HeaderInfo{packetType: PacketTypeState, direction: CmdIncomingPacket, timestamp: monotonicTimeMs}, payload)
+	if writeErr != nil {
+		return writeErr
+	}
+	if c.keyframeInterval > 0 {
+		c.keyframe = append(c.keyframe[:0], stateOctets...)
+		c.keyframePacketIndex = packetIndex
+		c.hasKeyframe = true
+		c.statesSinceKeyframe = 0
+	}
+	return nil
+}
+
 func (c *OutPacketFile) DebugState(stateOctets []byte, monotonicTimeMs int64) error {
-	s := outstream.New()
-	s.WriteUint64(uint64(monotonicTimeMs))
-	s.WriteOctets(stateOctets)
-	return c.outFile.WriteChunkTypeIDString("sta1", s.Octets())
+	if c.keyframeInterval <= 0 || !c.hasKeyframe || c.statesSinceKeyframe+1 >= c.keyframeInterval {
+		return c.writeStateKeyframe(stateOctets, monotonicTimeMs)
+	}
+
+	diff, diffErr := diffOctets(c.keyframe, stateOctets)
+	if diffErr != nil {
+		return diffErr
+	}
+	if len(diff) >= len(stateOctets) {
+		return c.writeStateKeyframe(stateOctets, monotonicTimeMs)
+	}
+	compressed, compressErr := c.compressor.compress(diff)
+	if compressErr != nil {
+		return compressErr
+	}
+	payload, serializeErr := serializeStateDelta(monotonicTimeMs, c.keyframePacketIndex, compressed)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk(c.compressor.typeID("std1"), HeaderInfo{packetType: PacketTypeState, direction: CmdIncomingPacket, timestamp: monotonicTimeMs}, payload)
+	if writeErr != nil {
+		return writeErr
+	}
+	c.statesSinceKeyframe++
+	return nil
+}
+
+// Annotate adds a marker with a label, and optional data, that can be used to find a moment in the capture.
+func (c *OutPacketFile) Annotate(monotonicTimeMs int64, label string, data []byte) error {
+	payload, serializeErr := serializeAnnotation(monotonicTimeMs, label, data)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk("ann1", HeaderInfo{packetType: PacketTypeAnnotation, direction: CmdIncomingPacket, timestamp: monotonicTimeMs}, payload)
+	return writeErr
+}
+
+// SyncWallClock records which wall clock time the monotonic time corresponds to.
+// The first sync is used as the start time of the capture.
+func (c *OutPacketFile) SyncWallClock(monotonicTimeMs int64, wallClock time.Time) error {
+	payload, serializeErr := serializeClockSync(monotonicTimeMs, wallClock)
+	if serializeErr != nil {
+		return serializeErr
+	}
+	_, writeErr := c.writeChunk("clk1", HeaderInfo{packetType: PacketTypeClockSync, direction: CmdIncomingPacket, timestamp: monotonicTimeMs}, payload)
+	if writeErr != nil {
+		return writeErr
+	}
+	c.lastWallClockSyncMs = monotonicTimeMs
+	c.hasWallClockSync = true
+	return nil
+}
+
+// EnableWallClockSync makes the file record the current wall clock before the first packet or state,
+// and then every intervalMs. It assumes that packets and states are written as they happen.
+func (c *OutPacketFile) EnableWallClockSync(intervalMs int64) {
+	c.wallClockSyncIntervalMs = intervalMs
+	if c.now == nil {
+		c.now = time.Now
+	}
+}
+
+func (c *OutPacketFile) syncWallClockIfNeeded(monotonicTimeMs int64) error {
+	if c.wallClockSyncIntervalMs <= 0 {
+		return nil
+	}
+	if c.hasWallClockSync && monotonicTimeMs-c.lastWallClockSyncMs < c.wallClockSyncIntervalMs {
+		return nil
+	}
+	return c.SyncWallClock(monotonicTimeMs, c.now())
+}
+
+// Flush reports if any of the written chunks has failed to reach the underlying file or writer. Chunks are not
+// buffered in OutPacketFile, but if the writer has a Flush method it is called as well.
+func (c *OutPacketFile) Flush() error {
+	previousErr := c.checkErr()
+	if previousErr != nil {
+		return previousErr
+	}
+	if c.forwarder == nil {
+		return nil
+	}
+	flushErr := c.forwarder.flush()
+	if flushErr != nil {
+		c.err = flushErr
+	}
+	return flushErr
+}
+
+// Sync commits the written chunks to stable storage. Only supported for files.
+func (c *OutPacketFile) Sync() error {
+	previousErr := c.checkErr()
+	if previousErr != nil {
+		return previousErr
+	}
+	if c.file == nil {
+		return fmt.Errorf("sync is only supported when writing to a file")
+	}
+	return c.file.Sync()
+}
+
+func closeFile(file *os.File) error {
+	closeErr := file.Close()
+	if errors.Is(closeErr, os.ErrClosed) {
+		return nil
+	}
+	return closeErr
 }
 
-func (c *OutPacketFile) Close() {
+// Close writes the index and closes the file. The first error from any of the steps is returned, and calling Close
+// again returns the same result.
+func (c *OutPacketFile) Close() error {
+	if c.closed {
+		return c.closeErr
+	}
+	c.closed = true
+	c.closeErr = c.writeIndex()
+
+	// The file is closed before the piff stream, since the stream does not report errors from closing it.
+	if c.file != nil {
+		closeErr := closeFile(c.file)
+		if c.closeErr == nil {
+			c.closeErr = closeErr
+		}
+	}
+	if c.forwarder != nil {
+		flushErr := c.forwarder.flush()
+		if c.closeErr == nil {
+			c.closeErr = flushErr
+		}
+		closeErr := c.forwarder.close()
+		if c.closeErr == nil {
+			c.closeErr = closeErr
+		}
+	}
 	c.outFile.Close()
+
+	return c.closeErr
 }
@@ -0,0 +1,185 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+)
+
+type RotationLimits struct {
+	// MaxOctetCount is the approximate maximum size of a segment, counted as the payload octets of its chunks.
+	// Zero means no limit.
+	MaxOctetCount int64
+	// MaxDurationMs is the maximum monotonic time span of a segment. Zero means no limit.
+	MaxDurationMs int64
+}
+
+// RotatingOutPacketFile writes to a sequence of segment files, starting a new segment when a limit is reached.
+// Each segment starts with the header, the schema and the most recent state, so it can be replayed on its own.
+type RotatingOutPacketFile struct {
+	filenamePrefix string
+	header         Header
+	schemaPayload  []byte
+	limits         RotationLimits
+
+	current           *OutPacketFile
+	filenames         []string
+	segmentStartTime  int64
+	segmentOctetCount int64
+
+	hasState      bool
+	lastState     []byte
+	lastStateTime int64
+}
+
+func NewRotatingOutPacketFile(filenamePrefix string, header Header, schemaPayload []byte, limits RotationLimits) (*RotatingOutPacketFile, error) {
+	c := &RotatingOutPacketFile{
+		filenamePrefix: filenamePrefix,
+		header:         header,
+		schemaPayload:  schemaPayload,
+		limits:         limits,
+	}
+	openErr := c.openSegment()
+	if openErr != nil {
+		return nil, openErr
+	}
+	return c, nil
+}
+
+func (c *RotatingOutPacketFile) segmentFilename(segmentIndex int) string {
+	return fmt.Sprintf("%s_%04d.ibdf", c.filenamePrefix, segmentIndex)
+}
+
+func (c *RotatingOutPacketFile) openSegment() error {
+	filename := c.segmentFilename(len(c.filenames))
+	newFile, createErr := NewOutPacketFile(filename, c.header, c.schemaPayload)
+	if createErr != nil {
+		return createErr
+	}
+	c.current = newFile
+	c.filenames = append(c.filenames, filename)
+	c.segmentOctetCount = 0
+	return nil
+}
+
+func (c *RotatingOutPacketFile) limitReached(monotonicTimeMs int64) bool {
+	if c.limits.MaxOctetCount > 0 && c.segmentOctetCount >= c.limits.MaxOctetCount {
+		return true
+	}
+	return c.limits.MaxDurationMs > 0 && monotonicTimeMs-c.segmentStartTime >= c.limits.MaxDurationMs
+}
+
+// rotateIfNeeded starts a new segment if a limit has been reached. A segment is never started before
+// the first state, since it would not be possible to replay it.
+func (c *RotatingOutPacketFile) rotateIfNeeded(monotonicTimeMs int64, isState bool) error {
+	if !c.hasState {
+		if isState {
+			c.segmentStartTime = monotonicTimeMs
+		}
+		return nil
+	}
+	if !c.limitReached(monotonicTimeMs) {
+		return nil
+	}
+
+	closeErr := c.current.Close()
+	if closeErr != nil {
+		return closeErr
+	}
+	openErr := c.openSegment()
+	if openErr != nil {
+		return openErr
+	}
+	c.segmentStartTime = monotonicTimeMs
+	if isState {
+		return nil
+	}
+	// the repeated state is not counted, otherwise a large state could trigger a rotation for every packet
+	return c.current.DebugState(c.lastState, c.lastStateTime)
+}
+
+func (c *RotatingOutPacketFile) writeState(stateOctets []byte, monotonicTimeMs int64) error {
+	writeErr := c.current.DebugState(stateOctets, monotonicTimeMs)
+	if writeErr != nil {
+		return writeErr
+	}
+	c.segmentOctetCount += int64(pktHeaderStateOctetCount + len(stateOctets))
+	return nil
+}
+
+func (c *RotatingOutPacketFile) writePacket(cmd PacketDirection, monotonicTimeMs int64, b []byte) error {
+	rotateErr := c.rotateIfNeeded(monotonicTimeMs, false)
+	if rotateErr != nil {
+		return rotateErr
+	}
+	writeErr := c.current.writePacket(cmd, monotonicTimeMs, b)
+	if writeErr != nil {
+		return writeErr
+	}
+	c.segmentOctetCount += int64(pktHeaderOctetCount + len(b))
+	return nil
+}
+
+func (c *RotatingOutPacketFile) DebugIncomingPacket(b []byte, monotonicTimeMs int64) error {
+	return c.writePacket(CmdIncomingPacket, monotonicTimeMs, b)
+}
+
+func (c *RotatingOutPacketFile) DebugOutgoingPacket(b []byte, monotonicTimeMs int64) error {
+	return c.writePacket(CmdOutgoingPacket, monotonicTimeMs, b)
+}
+
+func (c *RotatingOutPacketFile) DebugState(stateOctets []byte, monotonicTimeMs int64) error {
+	rotateErr := c.rotateIfNeeded(monotonicTimeMs, true)
+	if rotateErr != nil {
+		return rotateErr
+	}
+	writeErr := c.writeState(stateOctets, monotonicTimeMs)
+	if writeErr != nil {
+		return writeErr
+	}
+	c.hasState = true
+	c.lastState = append(c.lastState[:0], stateOctets...)
+	c.lastStateTime = monotonicTimeMs
+	return nil
+}
+
+// Filenames returns the filenames of all segments written so far, the last one being the current segment.
+func (c *RotatingOutPacketFile) Filenames() []string {
+	return c.filenames
+}
+
+func (c *RotatingOutPacketFile) Flush() error {
+	return c.current.Flush()
+}
+
+func (c *RotatingOutPacketFile) Sync() error {
+	return c.current.Sync()
+}
+
+func (c *RotatingOutPacketFile) Close() error {
+	return c.current.Close()
+}
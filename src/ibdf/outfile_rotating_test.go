@@ -0,0 +1,154 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"testing"
+)
+
+func TestRotateOnDuration(t *testing.T) {
+	f, createErr := NewRotatingOutPacketFile("test_rotating", Header{CompanyName: "SomeCompany"}, []byte("schema"), RotationLimits{MaxDurationMs: 100})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	writeErr := f.DebugState([]byte("state"), 0)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("first"), 50)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("second"), 120)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("third"), 150)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	filenames := f.Filenames()
+	if len(filenames) != 2 {
+		t.Fatalf("expected two segments, got %v", filenames)
+	}
+
+	pf, openErr := NewInPacketFile(filenames[1])
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if pf.Header().CompanyName != "SomeCompany" || string(pf.SchemaPayload()) != "schema" {
+		t.Errorf("segment should repeat header and schema")
+	}
+	seq, seqErr := NewInPacketFileSequenceFromInFile(pf)
+	if seqErr != nil {
+		t.Fatal(seqErr)
+	}
+	defer seq.Close()
+
+	stateTime, state, stateErr := seq.ReadNextStatePacket()
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if stateTime != 0 || string(state) != "state" {
+		t.Errorf("segment should start with the most recent state")
+	}
+	_, packetTime, payload, packetErr := seq.ReadNextPacket()
+	if packetErr != nil {
+		t.Fatal(packetErr)
+	}
+	if packetTime != 120 || string(payload) != "second" {
+		t.Errorf("unexpected first packet in segment %v %v", packetTime, string(payload))
+	}
+}
+
+func TestRotateOnSize(t *testing.T) {
+	state := []byte("state")
+	packet := []byte("0123456789")
+	stateOctetCount := int64(pktHeaderStateOctetCount + len(state))
+	packetOctetCount := int64(pktHeaderOctetCount + len(packet))
+	limits := RotationLimits{MaxOctetCount: stateOctetCount + 2*packetOctetCount}
+	f, createErr := NewRotatingOutPacketFile("test_rotating_size", Header{CompanyName: "SomeCompany"}, []byte("schema"), limits)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	writeErr := f.DebugState(state, 0)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	// the third packet starts a new segment. The repeated state is not counted, so the fifth packet still fits.
+	for index := 0; index < 5; index++ {
+		writeErr = f.DebugIncomingPacket(packet, int64(10+index))
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	filenames := f.Filenames()
+	if len(filenames) != 2 {
+		t.Fatalf("expected two segments, got %v", filenames)
+	}
+
+	expectedPacketCounts := []int{2, 3}
+	for segmentIndex, filename := range filenames {
+		pf, openErr := NewInPacketFile(filename)
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		seq, seqErr := NewInPacketFileSequenceFromInFile(pf)
+		if seqErr != nil {
+			t.Fatal(seqErr)
+		}
+		stateTime, readState, stateErr := seq.ReadNextStatePacket()
+		if stateErr != nil {
+			t.Fatal(stateErr)
+		}
+		if stateTime != 0 || string(readState) != "state" {
+			t.Errorf("segment %v should start with the most recent state", segmentIndex)
+		}
+		packetCount := 0
+		for {
+			_, _, _, packetErr := seq.ReadNextPacket()
+			if packetErr != nil {
+				break
+			}
+			packetCount++
+		}
+		seq.Close()
+		if packetCount != expectedPacketCounts[segmentIndex] {
+			t.Errorf("segment %v: expected %v packets, got %v", segmentIndex, expectedPacketCounts[segmentIndex], packetCount)
+		}
+	}
+}
@@ -27,9 +27,15 @@ SOFTWARE.
 package ibdf
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"io"
+	"os"
 	"testing"
+
+	"github.com/piot/piff-go/src/piff"
 )
 
 func TestReadWritePacket(t *testing.T) {
@@ -154,3 +160,325 @@ func TestReadWritePacket(t *testing.T) {
 
 	i.Close()
 }
+
+type failingWriter struct {
+	acceptedWriteCount int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.acceptedWriteCount == 0 {
+		return 0, errors.New("disk is full")
+	}
+	w.acceptedWriteCount--
+	return len(p), nil
+}
+
+func TestCloseReportsWriteError(t *testing.T) {
+	f, outErr := NewOutPacketWriter(&failingWriter{acceptedWriteCount: 2}, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	stateErr := f.DebugState([]byte("state"), 10)
+	if stateErr == nil || stateErr.Error() != "disk is full" {
+		t.Errorf("expected the write error to be returned when it happens, got %v", stateErr)
+	}
+	f.DebugIncomingPacket([]byte("in"), 12)
+
+	closeErr := f.Close()
+	if closeErr == nil || closeErr.Error() != "disk is full" {
+		t.Errorf("expected close to report the write error, got %v", closeErr)
+	}
+	if f.Close() != closeErr {
+		t.Errorf("expected a second close to return the same error")
+	}
+}
+
+func TestFailedWriterCreationLeavesWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	_, outErr := NewOutPacketWriter(&buf, Header{Compression: 9}, nil)
+	if outErr == nil || outErr.Error() != "unsupported compression 9" {
+		t.Fatalf("expected an unsupported compression to be rejected, got %v", outErr)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %q", buf.Bytes())
+	}
+}
+
+func TestFlushReachesWriter(t *testing.T) {
+	var buf bytes.Buffer
+	bufferedWriter := bufio.NewWriter(&buf)
+	f, outErr := NewOutPacketWriter(bufferedWriter, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	writeErr := f.DebugState([]byte("state"), 10)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	flushErr := f.Flush()
+	if flushErr != nil {
+		t.Fatal(flushErr)
+	}
+	if bufferedWriter.Buffered() != 0 || buf.Len() == 0 {
+		t.Errorf("expected flush to move all octets to the writer, %v still buffered", bufferedWriter.Buffered())
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Error(closeErr)
+	}
+}
+
+func TestFlushAndSync(t *testing.T) {
+	f, outErr := NewOutPacketFile("test_sync.ibdf", Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	writeErr := f.DebugState([]byte("state"), 10)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	flushErr := f.Flush()
+	if flushErr != nil {
+		t.Error(flushErr)
+	}
+	syncErr := f.Sync()
+	if syncErr != nil {
+		t.Error(syncErr)
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Error(closeErr)
+	}
+}
+
+func TestCompressedStates(t *testing.T) {
+	const ibdFilename = "test_compressed.ibdf"
+	state := bytes.Repeat([]byte("redundant state "), 100)
+
+	f, outErr := NewOutPacketFile(ibdFilename, Header{CompanyName: "SomeCompany", Compression: CompressionDeflate}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	writeErr := f.DebugState(state, 10)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	writeErr = f.DebugIncomingPacket([]byte("packet"), 11)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if pf.Header().Compression != CompressionDeflate || pf.Header().CompanyName != "SomeCompany" {
+		t.Errorf("wrong header %v", pf.Header())
+	}
+	if pf.AllHeaders()[2].OctetCount() >= len(state) {
+		t.Errorf("state was not compressed")
+	}
+	if pf.typeID(2) != "stz1" || pf.typeID(3) != "pkz1" {
+		t.Errorf("compressed chunks should have their own type ids, got %v and %v", pf.typeID(2), pf.typeID(3))
+	}
+	i, iErr := NewInPacketFileSequenceFromInFile(pf)
+	if iErr != nil {
+		t.Fatal(iErr)
+	}
+	defer i.Close()
+	_, readState, stateErr := i.ReadNextStatePacket()
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if !bytes.Equal(readState, state) {
+		t.Errorf("state was not decompressed")
+	}
+	_, _, payload, packetErr := i.ReadNextPacket()
+	if packetErr != nil {
+		t.Fatal(packetErr)
+	}
+	if string(payload) != "packet" {
+		t.Errorf("packet was not decompressed '%s'", payload)
+	}
+}
+
+func TestStateDeltas(t *testing.T) {
+	const ibdFilename = "test_delta.ibdf"
+	states := [][]byte{
+		bytes.Repeat([]byte("a"), 100),
+		append(bytes.Repeat([]byte("a"), 50), bytes.Repeat([]byte("b"), 50)...),
+		append(bytes.Repeat([]byte("a"), 99), 'c', 'd'),
+		bytes.Repeat([]byte("e"), 100),
+	}
+
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.EnableStateDeltas(3)
+	for index, state := range states {
+		writeErr := f.DebugState(state, int64(index*10))
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	i, iErr := NewInPacketFileSequenceFromInFile(pf)
+	if iErr != nil {
+		t.Fatal(iErr)
+	}
+	defer i.Close()
+	for index, state := range states {
+		_, readState, readErr := i.SeekAndGetState(int64(index * 10))
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(readState, state) {
+			t.Errorf("state %v was not reconstructed '%s'", index, readState)
+		}
+	}
+	if pf.AllHeaders()[3].OctetCount() >= len(states[1]) {
+		t.Errorf("second state should be stored as a delta")
+	}
+
+	file, fileErr := os.Open(ibdFilename)
+	if fileErr != nil {
+		t.Fatal(fileErr)
+	}
+	defer file.Close()
+	inStream, streamErr := NewInPacketStream(file)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	stateIndex := 0
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		if record.Type() != RecordTypeState {
+			continue
+		}
+		if !bytes.Equal(record.Payload(), states[stateIndex]) {
+			t.Errorf("streamed state %v was not reconstructed", stateIndex)
+		}
+		stateIndex++
+	}
+}
+
+func TestStateDeltasWithWallClockSync(t *testing.T) {
+	const ibdFilename = "test_delta_wall_clock.ibdf"
+	states := [][]byte{
+		bytes.Repeat([]byte("a"), 100),
+		append(bytes.Repeat([]byte("a"), 50), bytes.Repeat([]byte("b"), 50)...),
+		append(bytes.Repeat([]byte("a"), 99), 'c', 'd'),
+	}
+
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	f.EnableStateDeltas(3)
+	f.EnableWallClockSync(5)
+	for index, state := range states {
+		writeErr := f.DebugState(state, int64(index*10))
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	i, iErr := NewInPacketFileSequenceFromInFile(pf)
+	if iErr != nil {
+		t.Fatal(iErr)
+	}
+	defer i.Close()
+	for index, state := range states {
+		_, readState, readErr := i.SeekAndGetState(int64(index * 10))
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(readState, state) {
+			t.Errorf("state %v was not reconstructed '%s'", index, readState)
+		}
+	}
+}
+
+func TestStateDeltaWithImpossibleLengthIsCorrupt(t *testing.T) {
+	diff := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	var header piff.InHeader
+	_, applyErr := applyDiff(header, []byte("keyframe"), diff)
+	var corruptErr *CorruptChunkError
+	if !errors.As(applyErr, &corruptErr) {
+		t.Errorf("expected a corrupt chunk error, got %v", applyErr)
+	}
+}
+
+func TestDecompressionIsLimited(t *testing.T) {
+	const ibdFilename = "test_decompression_limit.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{Compression: CompressionDeflate}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	compressed, compressErr := f.compressor.compress(make([]byte, maxDecompressedOctetCount+1))
+	if compressErr != nil {
+		t.Fatal(compressErr)
+	}
+	payload, serializeErr := serializePacket(CmdIncomingPacket, 12, compressed)
+	if serializeErr != nil {
+		t.Fatal(serializeErr)
+	}
+	writeErr := f.outFile.WriteChunkTypeIDString("pkz1", payload)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	f.Close()
+
+	file, openErr := os.Open(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+	inStream, streamErr := NewInPacketStream(file)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr == io.EOF {
+			t.Fatal("expected the oversized packet to be reported")
+		}
+		if nextErr != nil {
+			var corruptErr *CorruptChunkError
+			if !errors.As(nextErr, &corruptErr) {
+				t.Fatalf("expected a corrupt chunk error, got %v", nextErr)
+			}
+			return
+		}
+		if record.Type() == RecordTypePacket {
+			t.Fatalf("oversized packet was accepted")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+// chunkForwarder moves the octets of every chunk to the writer as soon as piff has written them to the scratch file,
+// since piff can only write to files. The scratch file is emptied after each chunk, so it never holds more than one.
+type chunkForwarder struct {
+	scratch             *os.File
+	writer              io.Writer
+	octets              []byte
+	forwardedOctetCount int64
+}
+
+func (f *chunkForwarder) forward() error {
+	octetCount, seekErr := f.scratch.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		return seekErr
+	}
+	if octetCount == 0 {
+		return nil
+	}
+	if int64(cap(f.octets)) < octetCount {
+		f.octets = make([]byte, octetCount)
+	}
+	octets := f.octets[:octetCount]
+	_, readErr := f.scratch.ReadAt(octets, 0)
+	if readErr != nil {
+		return readErr
+	}
+	_, writeErr := f.writer.Write(octets)
+	if writeErr != nil {
+		return writeErr
+	}
+	f.forwardedOctetCount += octetCount
+
+	truncateErr := f.scratch.Truncate(0)
+	if truncateErr != nil {
+		return truncateErr
+	}
+	_, rewindErr := f.scratch.Seek(0, io.SeekStart)
+	return rewindErr
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func (f *chunkForwarder) flush() error {
+	writerWithFlush, hasFlush := f.writer.(flusher)
+	if !hasFlush {
+		return nil
+	}
+	return writerWithFlush.Flush()
+}
+
+func (f *chunkForwarder) close() error {
+	closeErr := closeFile(f.scratch)
+	removeErr := os.Remove(f.scratch.Name())
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+// NewOutPacketWriter creates a packet file that writes to any writer. Each chunk has been written to the writer
+// when the Debug* call returns.
+func NewOutPacketWriter(writer io.Writer, header Header, schemaPayload []byte) (*OutPacketFile, error) {
+	scratch, scratchErr := ioutil.TempFile("", "ibdf-writer-*")
+	if scratchErr != nil {
+		return nil, scratchErr
+	}
+	forwarder := &chunkForwarder{scratch: scratch, writer: writer}
+
+	newPiffFile, err := piff.NewOutStreamFile(scratch)
+	if err != nil {
+		forwarder.close()
+		return nil, err
+	}
+
+	c := &OutPacketFile{outFile: newPiffFile, forwarder: forwarder}
+	createErr := forwarder.forward()
+	if createErr == nil {
+		createErr = c.writeStart(header, schemaPayload)
+	}
+	if createErr != nil {
+		forwarder.close()
+		newPiffFile.Close()
+		return nil, createErr
+	}
+
+	return c, nil
+}
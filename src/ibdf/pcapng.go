@@ -0,0 +1,273 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	pcapngSectionHeaderBlock   = 0x0A0D0D0A
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacketBlock  = 0x00000006
+	pcapngByteOrderMagic       = 0x1A2B3C4D
+
+	pcapngOptionEnd                 = 0
+	pcapngOptionComment             = 1
+	pcapngOptionInterfaceName       = 2
+	pcapngOptionTimestampResolution = 9
+	pcapngOptionPacketFlags         = 2
+
+	pcapngLinkTypeIPv4  = 228
+	pcapngLinkTypeUser0 = 147
+
+	pcapngFlagInbound  = 0x01
+	pcapngFlagOutbound = 0x02
+
+	pcapngPacketInterface = 0
+	pcapngStateInterface  = 1
+
+	ipv4HeaderOctetCount = 20
+	udpHeaderOctetCount  = 8
+
+	pcapngServerPort = 32001
+	pcapngClientPort = 32000
+)
+
+var pcapngServerIP = [4]byte{10, 0, 0, 1}
+
+func pcapngPad(octets []byte) []byte {
+	for len(octets)%4 != 0 {
+		octets = append(octets, 0)
+	}
+	return octets
+}
+
+func appendPcapngOption(octets []byte, code uint16, value []byte) []byte {
+	var optionHeader [4]byte
+	binary.LittleEndian.PutUint16(optionHeader[0:], code)
+	binary.LittleEndian.PutUint16(optionHeader[2:], uint16(len(value)))
+	octets = append(octets, optionHeader[:]...)
+	return pcapngPad(append(octets, value...))
+}
+
+func writePcapngBlock(writer io.Writer, blockType uint32, body []byte) error {
+	body = pcapngPad(body)
+	totalOctetCount := uint32(12 + len(body))
+	block := make([]byte, 8, totalOctetCount)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], totalOctetCount)
+	block = append(block, body...)
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], totalOctetCount)
+	block = append(block, trailer[:]...)
+	_, writeErr := writer.Write(block)
+	return writeErr
+}
+
+func writePcapngSectionHeader(writer io.Writer, comment string) error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	binary.LittleEndian.PutUint64(body[8:], 0xffffffffffffffff)
+	body = appendPcapngOption(body, pcapngOptionComment, []byte(comment))
+	body = appendPcapngOption(body, pcapngOptionEnd, nil)
+	return writePcapngBlock(writer, pcapngSectionHeaderBlock, body)
+}
+
+func writePcapngInterface(writer io.Writer, linkType uint16, name string) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], linkType)
+	body = appendPcapngOption(body, pcapngOptionInterfaceName, []byte(name))
+	// timestamps are in milliseconds, 10^-3 seconds
+	body = appendPcapngOption(body, pcapngOptionTimestampResolution, []byte{3})
+	body = appendPcapngOption(body, pcapngOptionEnd, nil)
+	return writePcapngBlock(writer, pcapngInterfaceDescription, body)
+}
+
+func writePcapngPacket(writer io.Writer, interfaceID uint32, monotonicTimeMs uint64, flags uint32, comment string, data []byte) error {
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:], interfaceID)
+	binary.LittleEndian.PutUint32(body[4:], uint32(monotonicTimeMs>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(monotonicTimeMs))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = pcapngPad(append(body, data...))
+	if flags != 0 {
+		var flagOctets [4]byte
+		binary.LittleEndian.PutUint32(flagOctets[:], flags)
+		body = appendPcapngOption(body, pcapngOptionPacketFlags, flagOctets[:])
+	}
+	if comment != "" {
+		body = appendPcapngOption(body, pcapngOptionComment, []byte(comment))
+	}
+	body = appendPcapngOption(body, pcapngOptionEnd, nil)
+	return writePcapngBlock(writer, pcapngEnhancedPacketBlock, body)
+}
+
+// pcapngMaxConnectionID is the largest connection id that gets an address of its own in 10.0.0.0/8.
+const pcapngMaxConnectionID = 0xffffff - 3
+
+// clientIP gives every connection an address after the server address, so connection id n is 10.0.0.2 + n.
+// Larger connection ids wrap around and share addresses, instead of failing the whole export.
+func clientIP(connectionID ConnectionID) [4]byte {
+	host := uint32(connectionID)%(pcapngMaxConnectionID+1) + 2
+	return [4]byte{10, byte(host >> 16), byte(host >> 8), byte(host)}
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// udpDatagram wraps the payload in synthetic IPv4 and UDP headers. Incoming packets are sent from the client to the
+// server and outgoing packets from the server to the client.
+func udpDatagram(direction PacketDirection, connectionID ConnectionID, payload []byte) ([]byte, error) {
+	totalOctetCount := ipv4HeaderOctetCount + udpHeaderOctetCount + len(payload)
+	if totalOctetCount > 0xffff {
+		return nil, fmt.Errorf("packet of %v octets does not fit in an IPv4 datagram", len(payload))
+	}
+	source, destination := clientIP(connectionID), pcapngServerIP
+	sourcePort, destinationPort := uint16(pcapngClientPort), uint16(pcapngServerPort)
+	if direction == CmdOutgoingPacket {
+		source, destination = destination, source
+		sourcePort, destinationPort = destinationPort, sourcePort
+	}
+
+	datagram := make([]byte, totalOctetCount)
+	ip := datagram[:ipv4HeaderOctetCount]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(totalOctetCount))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], source[:])
+	copy(ip[16:20], destination[:])
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+
+	udp := datagram[ipv4HeaderOctetCount:]
+	binary.BigEndian.PutUint16(udp[0:], sourcePort)
+	binary.BigEndian.PutUint16(udp[2:], destinationPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderOctetCount+len(payload)))
+	copy(udp[udpHeaderOctetCount:], payload)
+
+	return datagram, nil
+}
+
+func hasWallClockSync(inFile *InPacketFile) bool {
+	for _, info := range inFile.AllHeaders() {
+		if info.packetType == PacketTypeClockSync {
+			return true
+		}
+	}
+	return false
+}
+
+// pcapngTimestamp is the wall clock time in milliseconds since 1970 if the capture has wall clock syncs, otherwise
+// the monotonic time of the capture.
+func pcapngTimestamp(inFile *InPacketFile, useWallClock bool, monotonicTimeMs uint64) (uint64, error) {
+	if !useWallClock {
+		return monotonicTimeMs, nil
+	}
+	wallClock, wallClockErr := inFile.WallClockTime(int64(monotonicTimeMs))
+	if wallClockErr != nil {
+		return 0, wallClockErr
+	}
+	return uint64(wallClock.UnixNano() / int64(time.Millisecond)), nil
+}
+
+// ExportPcapng writes the packets as a pcapng file that can be opened in Wireshark. Packets are written as UDP over
+// IPv4 between a server (10.0.0.1:32001) and one client address per connection (10.0.0.2 + connection id, port 32000),
+// with the direction in the packet flags. States are written with a comment on a separate interface, and the file
+// header is the section comment. Timestamps are wall clock times if the capture has wall clock syncs.
+func ExportPcapng(inFile *InPacketFile, writer io.Writer) error {
+	sectionErr := writePcapngSectionHeader(writer, inFile.Header().String())
+	if sectionErr != nil {
+		return sectionErr
+	}
+	packetInterfaceErr := writePcapngInterface(writer, pcapngLinkTypeIPv4, "ibdf packets")
+	if packetInterfaceErr != nil {
+		return packetInterfaceErr
+	}
+	stateInterfaceErr := writePcapngInterface(writer, pcapngLinkTypeUser0, "ibdf states")
+	if stateInterfaceErr != nil {
+		return stateInterfaceErr
+	}
+
+	useWallClock := hasWallClockSync(inFile)
+	for _, info := range inFile.AllHeaders() {
+		switch info.packetType {
+		case PacketTypeNormal:
+			_, connectionID, direction, monotonicTimeMs, payload, readErr := inFile.ReadConnectionPacket(info.packetIndex)
+			if readErr != nil {
+				return readErr
+			}
+			timestamp, timestampErr := pcapngTimestamp(inFile, useWallClock, monotonicTimeMs)
+			if timestampErr != nil {
+				return timestampErr
+			}
+			datagram, datagramErr := udpDatagram(direction, connectionID, payload)
+			if datagramErr != nil {
+				return datagramErr
+			}
+			flags := uint32(pcapngFlagInbound)
+			if direction == CmdOutgoingPacket {
+				flags = pcapngFlagOutbound
+			}
+			writeErr := writePcapngPacket(writer, pcapngPacketInterface, timestamp, flags, "", datagram)
+			if writeErr != nil {
+				return writeErr
+			}
+		case PacketTypeState:
+			_, monotonicTimeMs, state, readErr := inFile.ReadStatePacket(info.packetIndex)
+			if readErr != nil {
+				return readErr
+			}
+			timestamp, timestampErr := pcapngTimestamp(inFile, useWallClock, monotonicTimeMs)
+			if timestampErr != nil {
+				return timestampErr
+			}
+			comment := fmt.Sprintf("state #%v (%v octets)", info.packetIndex, len(state))
+			writeErr := writePcapngPacket(writer, pcapngStateInterface, timestamp, 0, comment, state)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+
+	return nil
+}
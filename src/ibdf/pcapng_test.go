@@ -0,0 +1,154 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type pcapngTestBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPcapngBlocks(t *testing.T, octets []byte) []pcapngTestBlock {
+	var blocks []pcapngTestBlock
+	for len(octets) > 0 {
+		blockType := binary.LittleEndian.Uint32(octets[0:])
+		totalOctetCount := binary.LittleEndian.Uint32(octets[4:])
+		if totalOctetCount%4 != 0 || int(totalOctetCount) > len(octets) {
+			t.Fatalf("wrong block length %v", totalOctetCount)
+		}
+		if binary.LittleEndian.Uint32(octets[totalOctetCount-4:]) != totalOctetCount {
+			t.Fatalf("trailing block length does not match")
+		}
+		blocks = append(blocks, pcapngTestBlock{blockType: blockType, body: octets[8 : totalOctetCount-4]})
+		octets = octets[totalOctetCount:]
+	}
+	return blocks
+}
+
+func TestExportPcapng(t *testing.T) {
+	const ibdFilename = "test_pcapng.ibdf"
+	writeTestFile(t, ibdFilename)
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	var buf bytes.Buffer
+	exportErr := ExportPcapng(pf, &buf)
+	if exportErr != nil {
+		t.Fatal(exportErr)
+	}
+
+	blocks := readPcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 8 {
+		t.Fatalf("expected section, two interfaces and five packets, got %v blocks", len(blocks))
+	}
+	if blocks[0].blockType != pcapngSectionHeaderBlock || binary.LittleEndian.Uint32(blocks[0].body) != pcapngByteOrderMagic {
+		t.Errorf("wrong section header")
+	}
+	if !bytes.Contains(blocks[0].body, []byte("SomeCompany")) {
+		t.Errorf("expected the file header as section comment")
+	}
+
+	state := blocks[3].body
+	if binary.LittleEndian.Uint32(state[0:]) != pcapngStateInterface || binary.LittleEndian.Uint32(state[8:]) != 10 {
+		t.Errorf("expected first state at time 10 on the state interface")
+	}
+
+	incoming := blocks[4].body
+	if binary.LittleEndian.Uint32(incoming[0:]) != pcapngPacketInterface || binary.LittleEndian.Uint32(incoming[8:]) != 12 {
+		t.Errorf("expected incoming packet at time 12")
+	}
+	capturedOctetCount := binary.LittleEndian.Uint32(incoming[12:])
+	datagram := incoming[20 : 20+capturedOctetCount]
+	if datagram[0] != 0x45 || datagram[9] != 17 || ipv4Checksum(datagram[:ipv4HeaderOctetCount]) != 0 {
+		t.Errorf("wrong IPv4 header %v", datagram[:ipv4HeaderOctetCount])
+	}
+	if binary.BigEndian.Uint16(datagram[22:]) != pcapngServerPort || string(datagram[28:]) != "in" {
+		t.Errorf("wrong UDP datagram %v", datagram)
+	}
+	flagsOption := incoming[20+len(pcapngPad(append([]byte{}, datagram...))):]
+	if binary.LittleEndian.Uint16(flagsOption[0:]) != pcapngOptionPacketFlags || binary.LittleEndian.Uint32(flagsOption[4:]) != pcapngFlagInbound {
+		t.Errorf("expected inbound flag %v", flagsOption)
+	}
+}
+
+func TestExportPcapngUsesWallClock(t *testing.T) {
+	const ibdFilename = "test_pcapng_wall_clock.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	wallClock := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.SyncWallClock(100, wallClock)
+	f.DebugState([]byte("state"), 100)
+	f.DebugIncomingPacketOnConnection(pcapngMaxConnectionID+1, []byte("wrapped connection"), 110)
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer pf.Close()
+
+	var buf bytes.Buffer
+	exportErr := ExportPcapng(pf, &buf)
+	if exportErr != nil {
+		t.Fatal(exportErr)
+	}
+	blocks := readPcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 5 {
+		t.Fatalf("expected section, two interfaces, the state and the packet, got %v blocks", len(blocks))
+	}
+	state := blocks[3].body
+	timestamp := uint64(binary.LittleEndian.Uint32(state[4:]))<<32 | uint64(binary.LittleEndian.Uint32(state[8:]))
+	expected := uint64(wallClock.UnixNano() / int64(time.Millisecond))
+	if timestamp != expected {
+		t.Errorf("expected wall clock timestamp %v, got %v", expected, timestamp)
+	}
+}
+
+func TestClientIPWrapsAround(t *testing.T) {
+	if clientIP(1) != [4]byte{10, 0, 0, 3} {
+		t.Errorf("unexpected address for connection 1 %v", clientIP(1))
+	}
+	if clientIP(pcapngMaxConnectionID) != [4]byte{10, 255, 255, 254} {
+		t.Errorf("unexpected address for the max connection %v", clientIP(pcapngMaxConnectionID))
+	}
+	if clientIP(pcapngMaxConnectionID+2) != clientIP(1) {
+		t.Errorf("expected larger connection ids to wrap around, got %v", clientIP(pcapngMaxConnectionID+2))
+	}
+}
@@ -0,0 +1,212 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is used by Player to wait between packets. Tests can use a clock that does not depend on real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type SystemClock struct {
+}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Player replays the packets of a sequence with the same relative timing as when they were captured.
+// All methods except Play can be called from other goroutines while Play is running.
+type Player struct {
+	sequence *InPacketFileSequence
+	clock    Clock
+	wake     chan struct{}
+
+	lock      sync.Mutex
+	speed     float64
+	paused    bool
+	stopped   bool
+	stepCount int
+
+	anchored        bool
+	anchorWallClock time.Time
+	anchorTimestamp int64
+}
+
+func NewPlayer(sequence *InPacketFileSequence, clock Clock) *Player {
+	return &Player{sequence: sequence, clock: clock, speed: 1, wake: make(chan struct{}, 1)}
+}
+
+func (p *Player) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// position returns the capture time that is played at the specified wall clock time. The lock must be held.
+func (p *Player) position(now time.Time) int64 {
+	elapsedMs := float64(now.Sub(p.anchorWallClock)) / float64(time.Millisecond)
+	return p.anchorTimestamp + int64(elapsedMs*p.speed)
+}
+
+// SetSpeed sets how much faster than the original timing the packets are played, e.g. 2 for double speed.
+func (p *Player) SetSpeed(multiplier float64) error {
+	if multiplier <= 0 {
+		return fmt.Errorf("speed multiplier must be positive, got %v", multiplier)
+	}
+	p.lock.Lock()
+	if p.anchored && !p.paused {
+		now := p.clock.Now()
+		p.anchorTimestamp = p.position(now)
+		p.anchorWallClock = now
+	}
+	p.speed = multiplier
+	p.lock.Unlock()
+	p.signal()
+	return nil
+}
+
+func (p *Player) Pause() {
+	p.lock.Lock()
+	if p.anchored && !p.paused {
+		p.anchorTimestamp = p.position(p.clock.Now())
+	}
+	p.paused = true
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *Player) Resume() {
+	p.lock.Lock()
+	if !p.paused {
+		p.lock.Unlock()
+		return
+	}
+	p.paused = false
+	p.anchorWallClock = p.clock.Now()
+	p.lock.Unlock()
+	p.signal()
+}
+
+// Step plays the next packet immediately. It only has an effect when the player is paused.
+func (p *Player) Step() {
+	p.lock.Lock()
+	if p.paused {
+		p.stepCount++
+	}
+	p.lock.Unlock()
+	p.signal()
+}
+
+// Stop makes Play return as soon as possible.
+func (p *Player) Stop() {
+	p.lock.Lock()
+	p.stopped = true
+	p.lock.Unlock()
+	p.signal()
+}
+
+// StartFromTime moves to the closest state before or at the timestamp and returns it together with the packets between
+// the state and the timestamp, which should be applied before playing continues from the timestamp.
+func (p *Player) StartFromTime(timestamp int64) (Record, []Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	state, packets, seekErr := p.sequence.SeekToTime(timestamp)
+	if seekErr != nil {
+		return Record{}, nil, seekErr
+	}
+	p.anchored = false
+	p.signal()
+	return state, packets, nil
+}
+
+// Play calls emit for every packet at the time it should be played, until the end of the sequence is reached,
+// Stop is called or emit returns an error.
+func (p *Player) Play(emit func(Record) error) error {
+	for {
+		p.lock.Lock()
+		if p.stopped {
+			p.lock.Unlock()
+			return nil
+		}
+		info := p.sequence.skipToWantedPacket()
+		if info == nil {
+			p.lock.Unlock()
+			return nil
+		}
+		if p.paused {
+			if p.stepCount == 0 {
+				p.lock.Unlock()
+				<-p.wake
+				continue
+			}
+			p.stepCount--
+			p.anchored = true
+			p.anchorTimestamp = info.timestamp
+		} else {
+			now := p.clock.Now()
+			if !p.anchored {
+				p.anchored = true
+				p.anchorWallClock = now
+				p.anchorTimestamp = info.timestamp
+			}
+			untilPacket := time.Duration(float64(info.timestamp-p.anchorTimestamp) / p.speed * float64(time.Millisecond))
+			wait := p.anchorWallClock.Add(untilPacket).Sub(now)
+			if wait > 0 {
+				p.lock.Unlock()
+				select {
+				case <-p.clock.After(wait):
+				case <-p.wake:
+				}
+				continue
+			}
+		}
+		record, readErr := p.sequence.readRecord(p.sequence.cursorPacketIndex)
+		if readErr != nil {
+			p.lock.Unlock()
+			return readErr
+		}
+		p.sequence.advanceCursor()
+		p.lock.Unlock()
+
+		emitErr := emit(record)
+		if emitErr != nil {
+			return emitErr
+		}
+	}
+}
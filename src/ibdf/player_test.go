@@ -0,0 +1,141 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.now = f.now.Add(d)
+	fired := make(chan time.Time, 1)
+	fired <- f.now
+	return fired
+}
+
+func openTestSequence(t *testing.T, filename string) *InPacketFileSequence {
+	writeTestFile(t, filename)
+	pf, openErr := NewInPacketFile(filename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	sequence, sequenceErr := NewInPacketFileSequenceFromInFile(pf)
+	if sequenceErr != nil {
+		t.Fatal(sequenceErr)
+	}
+	return sequence
+}
+
+func TestPlayerKeepsRelativeTiming(t *testing.T) {
+	sequence := openTestSequence(t, "test_player.ibdf")
+	defer sequence.Close()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	start := clock.now
+	player := NewPlayer(sequence, clock)
+	player.SetSpeed(2)
+
+	var emitted []time.Duration
+	playErr := player.Play(func(record Record) error {
+		emitted = append(emitted, clock.Now().Sub(start))
+		return nil
+	})
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	expected := []time.Duration{0, 1500 * time.Microsecond, 6500 * time.Microsecond}
+	if len(emitted) != len(expected) {
+		t.Fatalf("wrong packet count %v", emitted)
+	}
+	for i, offset := range expected {
+		if emitted[i] != offset {
+			t.Errorf("packet %v played at %v, expected %v", i, emitted[i], offset)
+		}
+	}
+}
+
+func TestPlayerStartFromTime(t *testing.T) {
+	sequence := openTestSequence(t, "test_player_start.ibdf")
+	defer sequence.Close()
+	player := NewPlayer(sequence, &fakeClock{})
+
+	state, packets, startErr := player.StartFromTime(16)
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+	if string(state.Payload()) != "first state" || len(packets) != 2 {
+		t.Errorf("wrong state or packets %v %v", state, packets)
+	}
+	var payloads []string
+	player.Play(func(record Record) error {
+		payloads = append(payloads, string(record.Payload()))
+		return nil
+	})
+	if len(payloads) != 1 || payloads[0] != "last" {
+		t.Errorf("expected only the last packet to be played, got %v", payloads)
+	}
+}
+
+func TestPlayerStepWhilePaused(t *testing.T) {
+	sequence := openTestSequence(t, "test_player_step.ibdf")
+	defer sequence.Close()
+	player := NewPlayer(sequence, &fakeClock{})
+	player.Pause()
+
+	played := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- player.Play(func(record Record) error {
+			played <- string(record.Payload())
+			return nil
+		})
+	}()
+
+	player.Step()
+	payload := <-played
+	if payload != "in" {
+		t.Errorf("wrong first step %v", payload)
+	}
+	player.Step()
+	payload = <-played
+	if payload != "out" {
+		t.Errorf("wrong second step %v", payload)
+	}
+	player.Stop()
+	playErr := <-done
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+type RecordType uint8
+
+const (
+	RecordTypeFileHeader RecordType = iota
+	RecordTypeSchema
+	RecordTypeState
+	RecordTypePacket
+	RecordTypeIndex
+	RecordTypeUnknown
+	// new record types are added at the end, so the values of the existing ones never change
+	RecordTypeConnectionEvent
+	RecordTypeAnnotation
+	RecordTypeClockSync
+)
+
+func (t RecordType) String() string {
+	switch t {
+	case RecordTypeFileHeader:
+		return "header"
+	case RecordTypeSchema:
+		return "schema"
+	case RecordTypeState:
+		return "state"
+	case RecordTypePacket:
+		return "packet"
+	case RecordTypeIndex:
+		return "index"
+	case RecordTypeConnectionEvent:
+		return "connection"
+	case RecordTypeAnnotation:
+		return "annotation"
+	case RecordTypeClockSync:
+		return "clock sync"
+	default:
+		return "unknown"
+	}
+}
+
+type Record struct {
+	recordType      RecordType
+	typeID          string
+	chunkIndex      piff.ChunkIndex
+	timestamp       uint64
+	direction       PacketDirection
+	connectionID    ConnectionID
+	connectionEvent ConnectionEvent
+	label           string
+	wallClock       time.Time
+	fileHeader      Header
+	payload         []byte
+}
+
+func (r Record) Type() RecordType {
+	return r.recordType
+}
+
+// TypeID is the piff chunk type id, useful for identifying chunks of type RecordTypeUnknown.
+func (r Record) TypeID() string {
+	return r.typeID
+}
+
+func (r Record) ChunkIndex() piff.ChunkIndex {
+	return r.chunkIndex
+}
+
+func (r Record) Timestamp() uint64 {
+	return r.timestamp
+}
+
+func (r Record) PacketDirection() PacketDirection {
+	return r.direction
+}
+
+func (r Record) ConnectionID() ConnectionID {
+	return r.connectionID
+}
+
+// ConnectionEvent is only valid for records of type RecordTypeConnectionEvent.
+func (r Record) ConnectionEvent() ConnectionEvent {
+	return r.connectionEvent
+}
+
+// Label is only valid for records of type RecordTypeAnnotation.
+func (r Record) Label() string {
+	return r.label
+}
+
+// WallClock is only valid for records of type RecordTypeClockSync.
+func (r Record) WallClock() time.Time {
+	return r.wallClock
+}
+
+// FileHeader is only valid for records of type RecordTypeFileHeader.
+func (r Record) FileHeader() Header {
+	return r.fileHeader
+}
+
+func (r Record) Payload() []byte {
+	return r.payload
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("#%v %v (%v) time:%v octetCount:%v", r.chunkIndex, r.recordType, r.typeID, r.timestamp, len(r.payload))
+}
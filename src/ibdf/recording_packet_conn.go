@@ -0,0 +1,120 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RecordingPacketConn is a net.PacketConn that records every datagram that is read as incoming and every datagram that
+// is written as outgoing. Timestamps are milliseconds since the connection was wrapped.
+//
+// Errors from recording do not affect the network calls. The first one stops the recording and is returned by Err.
+//
+// The OutPacketFile is owned by the caller, but must only be written through RecordState while the connection is in
+// use, since reads and writes can be recorded from any goroutine.
+type RecordingPacketConn struct {
+	conn      net.PacketConn
+	file      *OutPacketFile
+	start     time.Time
+	lock      sync.Mutex
+	recordErr error
+}
+
+func NewRecordingPacketConn(conn net.PacketConn, file *OutPacketFile) *RecordingPacketConn {
+	return &RecordingPacketConn{conn: conn, file: file, start: time.Now()}
+}
+
+func (c *RecordingPacketConn) record(direction PacketDirection, octets []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.recordErr != nil {
+		return
+	}
+	monotonicTimeMs := time.Since(c.start).Milliseconds()
+	if direction == CmdIncomingPacket {
+		c.recordErr = c.file.DebugIncomingPacket(octets, monotonicTimeMs)
+	} else {
+		c.recordErr = c.file.DebugOutgoingPacket(octets, monotonicTimeMs)
+	}
+}
+
+// RecordState writes a state to the file, with the same clock as the recorded datagrams.
+func (c *RecordingPacketConn) RecordState(stateOctets []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.recordErr != nil {
+		return c.recordErr
+	}
+	c.recordErr = c.file.DebugState(stateOctets, time.Since(c.start).Milliseconds())
+	return c.recordErr
+}
+
+// Err returns the first error that happened while recording, or nil.
+func (c *RecordingPacketConn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recordErr
+}
+
+func (c *RecordingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	octetCount, addr, readErr := c.conn.ReadFrom(p)
+	if octetCount > 0 {
+		c.record(CmdIncomingPacket, p[:octetCount])
+	}
+	return octetCount, addr, readErr
+}
+
+func (c *RecordingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	octetCount, writeErr := c.conn.WriteTo(p, addr)
+	if writeErr == nil {
+		c.record(CmdOutgoingPacket, p[:octetCount])
+	}
+	return octetCount, writeErr
+}
+
+func (c *RecordingPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *RecordingPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *RecordingPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *RecordingPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *RecordingPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,140 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecordingPacketConn(t *testing.T) {
+	const ibdFilename = "test_packet_conn.ibdf"
+	f, outErr := NewOutPacketFile(ibdFilename, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	udpConn, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	peer, peerErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if peerErr != nil {
+		t.Fatal(peerErr)
+	}
+	defer peer.Close()
+
+	recording := NewRecordingPacketConn(udpConn, f)
+	stateErr := recording.RecordState([]byte("state"))
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	var conn net.PacketConn = recording
+	_, writeErr := conn.WriteTo([]byte("request"), peer.LocalAddr())
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	_, writeErr = peer.WriteTo([]byte("response"), conn.LocalAddr())
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	octetCount, _, readErr := conn.ReadFrom(buf)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if string(buf[:octetCount]) != "response" {
+		t.Errorf("wrong response %s", buf[:octetCount])
+	}
+	conn.Close()
+	if recording.Err() != nil {
+		t.Fatal(recording.Err())
+	}
+	closeErr := f.Close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	file, openErr := os.Open(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+	inStream, streamErr := NewInPacketStream(file)
+	if streamErr != nil {
+		t.Fatal(streamErr)
+	}
+	var packets []Record
+	stateCount := 0
+	for {
+		record, nextErr := inStream.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		if record.Type() == RecordTypePacket {
+			packets = append(packets, record)
+		}
+		if record.Type() == RecordTypeState {
+			stateCount++
+		}
+	}
+	if len(packets) != 2 || packets[0].PacketDirection() != CmdOutgoingPacket || string(packets[0].Payload()) != "request" ||
+		packets[1].PacketDirection() != CmdIncomingPacket || string(packets[1].Payload()) != "response" {
+		t.Errorf("wrong recorded packets %v", packets)
+	}
+	if stateCount != 1 {
+		t.Errorf("expected the recorded state, got %v states", stateCount)
+	}
+}
+
+func TestRecordingPacketConnKeepsFirstError(t *testing.T) {
+	f, outErr := NewOutPacketWriter(&failingWriter{acceptedWriteCount: 2}, Header{}, nil)
+	if outErr != nil {
+		t.Fatal(outErr)
+	}
+	defer f.Close()
+	udpConn, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	recording := NewRecordingPacketConn(udpConn, f)
+	defer recording.Close()
+
+	_, writeErr := recording.WriteTo([]byte("request"), udpConn.LocalAddr())
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if recording.Err() == nil || recording.Err().Error() != "disk is full" {
+		t.Errorf("expected the recording error, got %v", recording.Err())
+	}
+}
@@ -0,0 +1,207 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/piot/piff-go/src/piff"
+)
+
+type RecoveryReport struct {
+	ChunkCount          int
+	RecoveredOctetCount int64
+	DiscardedOctetCount int64
+}
+
+func (r RecoveryReport) String() string {
+	return fmt.Sprintf("[recovery chunks:%v recovered:%v discarded:%v octets]", r.ChunkCount, r.RecoveredOctetCount, r.DiscardedOctetCount)
+}
+
+type countingReader struct {
+	reader     io.Reader
+	octetCount int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	octetsRead, readErr := c.reader.Read(p)
+	c.octetCount += int64(octetsRead)
+	return octetsRead, readErr
+}
+
+// isTruncation reports if the error is caused by the file ending in the middle of a chunk.
+func isTruncation(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// RepairPacketFile copies every complete chunk from reader to file and discards the rest, e.g. the partial chunk
+// that is left when a server crashes in the middle of a write.
+func RepairPacketFile(reader io.Reader, file *os.File) (RecoveryReport, error) {
+	counter := &countingReader{reader: reader}
+	inStream, inErr := piff.NewInStreamReadSeeker(NewForwardReadSeeker(counter))
+	if inErr != nil {
+		return RecoveryReport{}, inErr
+	}
+	outStream, outErr := piff.NewOutStreamFile(file)
+	if outErr != nil {
+		return RecoveryReport{}, outErr
+	}
+
+	var report RecoveryReport
+	for !inStream.IsEOF() {
+		header, payload, readErr := inStream.ReadChunk()
+		if isTruncation(readErr) {
+			break
+		}
+		if readErr != nil {
+			outStream.Close()
+			return RecoveryReport{}, readErr
+		}
+		if report.ChunkCount == 0 && header.TypeIDString() != "pac1" {
+			outStream.Close()
+			return RecoveryReport{}, fmt.Errorf("not an ibdf file, first chunk is %v", header.TypeIDString())
+		}
+		writeErr := outStream.WriteChunkTypeIDString(header.TypeIDString(), payload)
+		if writeErr != nil {
+			outStream.Close()
+			return RecoveryReport{}, writeErr
+		}
+		report.ChunkCount++
+	}
+	outStream.Close()
+
+	if report.ChunkCount < 2 {
+		return RecoveryReport{}, fmt.Errorf("file header and schema are not complete, nothing to recover")
+	}
+
+	_, drainErr := io.Copy(ioutil.Discard, counter)
+	if drainErr != nil {
+		return RecoveryReport{}, drainErr
+	}
+	stat, statErr := os.Stat(file.Name())
+	if statErr != nil {
+		return RecoveryReport{}, statErr
+	}
+	report.RecoveredOctetCount = stat.Size()
+	report.DiscardedOctetCount = counter.octetCount - report.RecoveredOctetCount
+
+	return report, nil
+}
+
+// completeChunks returns the number of complete chunks in reader and how many octets they occupy.
+func completeChunks(reader io.Reader) (int, int64, error) {
+	inStream, inErr := piff.NewInStreamReadSeeker(NewForwardReadSeeker(reader))
+	if isTruncation(inErr) {
+		return 0, 0, nil
+	}
+	if inErr != nil {
+		return 0, 0, inErr
+	}
+	chunkCount := 0
+	octetCount := int64(0)
+	for !inStream.IsEOF() {
+		header, _, readErr := inStream.ReadChunk()
+		if isTruncation(readErr) {
+			break
+		}
+		if readErr != nil {
+			return 0, 0, readErr
+		}
+		chunkCount++
+		octetCount += piffChunkHeaderOctetCount + int64(header.OctetCount())
+	}
+	return chunkCount, octetCount, nil
+}
+
+// chunksOctetCount returns how many octets the chunks occupy, including their headers.
+func chunksOctetCount(allHeaders []*piff.SeekHeader) int64 {
+	octetCount := int64(0)
+	for _, seekHeader := range allHeaders {
+		octetCount += piffChunkHeaderOctetCount + int64(seekHeader.Header().OctetCount())
+	}
+	return octetCount
+}
+
+// NewInPacketFileTolerant opens a file that might be truncated, e.g. by a server that crashed in the middle of a write.
+// If the file ends in the middle of a chunk header or payload, it is opened up to the end of the last complete chunk
+// instead. Other errors are returned as they are.
+func NewInPacketFileTolerant(filename string) (*InPacketFile, RecoveryReport, error) {
+	file, openErr := os.Open(path.Clean(filename))
+	if openErr != nil {
+		return nil, RecoveryReport{}, openErr
+	}
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return nil, RecoveryReport{}, statErr
+	}
+
+	// The section reader is not closed with the InPacketFile, so the file can still be scanned if the chunks
+	// do not cover it exactly, e.g. when the last payload is cut short.
+	inFile, inErr := NewInPacketFileFromSeeker(io.NewSectionReader(file, 0, stat.Size()))
+	if inErr == nil {
+		allHeaders := inFile.inFile.AllHeaders()
+		if chunksOctetCount(allHeaders) == stat.Size() {
+			inFile.closer = file
+			return inFile, RecoveryReport{ChunkCount: len(allHeaders), RecoveredOctetCount: stat.Size()}, nil
+		}
+		inFile.Close()
+	} else if !isTruncation(inErr) {
+		file.Close()
+		return nil, RecoveryReport{}, inErr
+	}
+
+	_, rewindErr := file.Seek(0, io.SeekStart)
+	if rewindErr != nil {
+		file.Close()
+		return nil, RecoveryReport{}, rewindErr
+	}
+	chunkCount, octetCount, scanErr := completeChunks(file)
+	if scanErr != nil {
+		file.Close()
+		return nil, RecoveryReport{}, scanErr
+	}
+	if chunkCount < 2 {
+		file.Close()
+		return nil, RecoveryReport{}, fmt.Errorf("file header and schema are not complete, nothing to recover")
+	}
+
+	recoveredFile, recoveredErr := NewInPacketFileFromSeeker(io.NewSectionReader(file, 0, octetCount))
+	if recoveredErr != nil {
+		file.Close()
+		return nil, RecoveryReport{}, recoveredErr
+	}
+	recoveredFile.closer = file
+
+	return recoveredFile, RecoveryReport{ChunkCount: len(recoveredFile.inFile.AllHeaders()), RecoveredOctetCount: octetCount,
+		DiscardedOctetCount: stat.Size() - octetCount}, nil
+}
@@ -0,0 +1,170 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"io"
+	"sync"
+)
+
+type recordedChunk struct {
+	packetType      PacketType
+	direction       PacketDirection
+	monotonicTimeMs int64
+	octets          []byte
+}
+
+// RingRecorder keeps the most recent packets and states in memory, so they can be dumped when something goes wrong.
+// The last state older than the window is kept, so a dump can be replayed from the start of the window.
+type RingRecorder struct {
+	header        Header
+	schemaPayload []byte
+	windowMs      int64
+
+	lock       sync.Mutex
+	chunks     []recordedChunk
+	head       int
+	chunkCount int
+}
+
+func NewRingRecorder(header Header, schemaPayload []byte, windowMs int64) *RingRecorder {
+	return &RingRecorder{header: header, schemaPayload: schemaPayload, windowMs: windowMs}
+}
+
+func (c *RingRecorder) at(index int) *recordedChunk {
+	return &c.chunks[(c.head+index)%len(c.chunks)]
+}
+
+func (c *RingRecorder) grow() {
+	capacity := 2 * len(c.chunks)
+	if capacity == 0 {
+		capacity = 16
+	}
+	chunks := make([]recordedChunk, capacity)
+	for index := 0; index < c.chunkCount; index++ {
+		chunks[index] = *c.at(index)
+	}
+	c.chunks = chunks
+	c.head = 0
+}
+
+// trim drops the chunks before the last state older than the window. Without such a state,
+// nothing older than the window can be replayed, so all of it is dropped.
+func (c *RingRecorder) trim(windowStart int64) {
+	keepFrom := 0
+	foundState := false
+	olderCount := 0
+	for ; olderCount < c.chunkCount; olderCount++ {
+		chunk := c.at(olderCount)
+		if chunk.monotonicTimeMs > windowStart {
+			break
+		}
+		if chunk.packetType == PacketTypeState {
+			keepFrom = olderCount
+			foundState = true
+		}
+	}
+	if !foundState {
+		keepFrom = olderCount
+	}
+	for index := 0; index < keepFrom; index++ {
+		*c.at(0) = recordedChunk{}
+		c.head = (c.head + 1) % len(c.chunks)
+	}
+	c.chunkCount -= keepFrom
+}
+
+func (c *RingRecorder) add(packetType PacketType, direction PacketDirection, monotonicTimeMs int64, octets []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	octetsCopy := make([]byte, len(octets))
+	copy(octetsCopy, octets)
+	if c.chunkCount == len(c.chunks) {
+		c.grow()
+	}
+	c.chunkCount++
+	*c.at(c.chunkCount - 1) = recordedChunk{packetType: packetType, direction: direction, monotonicTimeMs: monotonicTimeMs, octets: octetsCopy}
+	c.trim(monotonicTimeMs - c.windowMs)
+}
+
+func (c *RingRecorder) DebugIncomingPacket(b []byte, monotonicTimeMs int64) error {
+	c.add(PacketTypeNormal, CmdIncomingPacket, monotonicTimeMs, b)
+	return nil
+}
+
+func (c *RingRecorder) DebugOutgoingPacket(b []byte, monotonicTimeMs int64) error {
+	c.add(PacketTypeNormal, CmdOutgoingPacket, monotonicTimeMs, b)
+	return nil
+}
+
+func (c *RingRecorder) DebugState(stateOctets []byte, monotonicTimeMs int64) error {
+	c.add(PacketTypeState, CmdIncomingPacket, monotonicTimeMs, stateOctets)
+	return nil
+}
+
+func (c *RingRecorder) snapshot() []recordedChunk {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	chunks := make([]recordedChunk, c.chunkCount)
+	for index := range chunks {
+		chunks[index] = *c.at(index)
+	}
+	return chunks
+}
+
+func (c *RingRecorder) dumpTo(out *OutPacketFile) error {
+	for _, chunk := range c.snapshot() {
+		var writeErr error
+		if chunk.packetType == PacketTypeState {
+			writeErr = out.DebugState(chunk.octets, chunk.monotonicTimeMs)
+		} else {
+			writeErr = out.writePacket(chunk.direction, chunk.monotonicTimeMs, chunk.octets)
+		}
+		if writeErr != nil {
+			out.Close()
+			return writeErr
+		}
+	}
+	return out.Close()
+}
+
+// Dump writes the recorded window as an ibdf stream. Recording can continue while dumping.
+func (c *RingRecorder) Dump(writer io.Writer) error {
+	out, createErr := NewOutPacketWriter(writer, c.header, c.schemaPayload)
+	if createErr != nil {
+		return createErr
+	}
+	return c.dumpTo(out)
+}
+
+func (c *RingRecorder) DumpToFile(filename string) error {
+	out, createErr := NewOutPacketFile(filename, c.header, c.schemaPayload)
+	if createErr != nil {
+		return createErr
+	}
+	return c.dumpTo(out)
+}
@@ -0,0 +1,122 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"io"
+	"testing"
+)
+
+func TestRingRecorderKeepsStateBeforeWindow(t *testing.T) {
+	recorder := NewRingRecorder(Header{}, nil, 100)
+	recorder.DebugState([]byte("too old"), 0)
+	recorder.DebugIncomingPacket([]byte("too old"), 10)
+	recorder.DebugState([]byte("state"), 50)
+	recorder.DebugIncomingPacket([]byte("before window"), 60)
+	recorder.DebugOutgoingPacket([]byte("in window"), 170)
+	recorder.DebugIncomingPacket([]byte("last"), 200)
+
+	const ibdFilename = "test_ring.ibdf"
+	dumpErr := recorder.DumpToFile(ibdFilename)
+	if dumpErr != nil {
+		t.Fatal(dumpErr)
+	}
+
+	pf, openErr := NewInPacketFile(ibdFilename)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	i, iErr := NewInPacketFileSequenceFromInFile(pf)
+	if iErr != nil {
+		t.Fatal(iErr)
+	}
+	defer i.Close()
+
+	stateTime, state, stateErr := i.ReadNextStatePacket()
+	if stateErr != nil {
+		t.Fatal(stateErr)
+	}
+	if stateTime != 50 || string(state) != "state" {
+		t.Errorf("dump should start with the last state before the window, got %v '%s'", stateTime, state)
+	}
+	packetCount := 0
+	for {
+		_, _, _, readErr := i.ReadNextPacket()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		packetCount++
+	}
+	if packetCount != 3 {
+		t.Errorf("expected 3 packets, got %v", packetCount)
+	}
+}
+
+func TestRingRecorderWrapsAround(t *testing.T) {
+	recorder := NewRingRecorder(Header{}, nil, 100)
+	for time := int64(0); time < 1000; time += 10 {
+		recorder.DebugState([]byte("state"), time)
+		recorder.DebugIncomingPacket([]byte("packet"), time+5)
+	}
+
+	chunks := recorder.snapshot()
+	if len(chunks) != 22 {
+		t.Fatalf("expected the window and the state before it, got %v chunks", len(chunks))
+	}
+	if len(recorder.chunks) > 32 {
+		t.Errorf("expected the ring to stay small, got capacity %v", len(recorder.chunks))
+	}
+	for index := 1; index < len(chunks); index++ {
+		if chunks[index].monotonicTimeMs < chunks[index-1].monotonicTimeMs {
+			t.Fatalf("chunks out of order at %v", index)
+		}
+	}
+	if chunks[0].packetType != PacketTypeState || chunks[0].monotonicTimeMs != 890 {
+		t.Errorf("expected the last state before the window first, got %v", chunks[0])
+	}
+}
+
+func TestRingRecorderDropsPacketsWithoutState(t *testing.T) {
+	recorder := NewRingRecorder(Header{}, nil, 10)
+	for time := int64(0); time < 10000; time++ {
+		recorder.DebugIncomingPacket([]byte("packet"), time)
+	}
+
+	chunks := recorder.snapshot()
+	if len(chunks) != 10 {
+		t.Fatalf("expected only the packets in the window, got %v chunks", len(chunks))
+	}
+	if chunks[0].monotonicTimeMs != 9990 {
+		t.Errorf("expected the window to start at 9990, got %v", chunks[0].monotonicTimeMs)
+	}
+	if len(recorder.chunks) > 16 {
+		t.Errorf("expected the ring to stay small, got capacity %v", len(recorder.chunks))
+	}
+}
@@ -0,0 +1,140 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+
+	"github.com/piot/brook-go/src/instream"
+	"github.com/piot/brook-go/src/outstream"
+	"github.com/piot/piff-go/src/piff"
+)
+
+// Differing ranges that are separated by fewer equal octets than this are merged into one range,
+// since every range has an overhead of eight octets.
+const diffMergeDistance = 8
+
+type diffRange struct {
+	start int
+	end   int
+}
+
+func findDifferingRanges(previous []byte, next []byte) []diffRange {
+	var ranges []diffRange
+	commonLength := len(previous)
+	if len(next) < commonLength {
+		commonLength = len(next)
+	}
+
+	for index := 0; index < commonLength; index++ {
+		if previous[index] == next[index] {
+			continue
+		}
+		rangeCount := len(ranges)
+		if rangeCount > 0 && index-ranges[rangeCount-1].end < diffMergeDistance {
+			ranges[rangeCount-1].end = index + 1
+		} else {
+			ranges = append(ranges, diffRange{start: index, end: index + 1})
+		}
+	}
+
+	if len(next) > commonLength {
+		ranges = append(ranges, diffRange{start: commonLength, end: len(next)})
+	}
+
+	return ranges
+}
+
+// diffOctets creates a diff that turns previous into next when applied with applyDiff.
+func diffOctets(previous []byte, next []byte) ([]byte, error) {
+	ranges := findDifferingRanges(previous, next)
+	s := outstream.New()
+	lengthErr := s.WriteUint32(uint32(len(next)))
+	if lengthErr != nil {
+		return nil, lengthErr
+	}
+	countErr := s.WriteUint32(uint32(len(ranges)))
+	if countErr != nil {
+		return nil, countErr
+	}
+	for _, r := range ranges {
+		startErr := s.WriteUint32(uint32(r.start))
+		if startErr != nil {
+			return nil, startErr
+		}
+		rangeLengthErr := s.WriteUint32(uint32(r.end - r.start))
+		if rangeLengthErr != nil {
+			return nil, rangeLengthErr
+		}
+		octetsErr := s.WriteOctets(next[r.start:r.end])
+		if octetsErr != nil {
+			return nil, octetsErr
+		}
+	}
+	return s.Octets(), nil
+}
+
+// applyDiff returns previous with the diff applied. The diff comes from the chunk described by header and is
+// validated before anything is allocated.
+func applyDiff(header piff.InHeader, previous []byte, diff []byte) ([]byte, error) {
+	s := instream.New(diff)
+	length, lengthErr := s.ReadUint32()
+	if lengthErr != nil {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("diff length: %v", lengthErr))
+	}
+	rangeCount, countErr := s.ReadUint32()
+	if countErr != nil {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("diff range count: %v", countErr))
+	}
+	// Octets after the end of previous can only come from the ranges in the diff.
+	if uint64(length) > uint64(len(previous))+uint64(len(diff)) {
+		return nil, newCorruptChunkError(header, fmt.Sprintf("diff state length %v is larger than keyframe and diff together", length))
+	}
+
+	next := make([]byte, length)
+	copy(next, previous)
+	for i := 0; i < int(rangeCount); i++ {
+		start, startErr := s.ReadUint32()
+		if startErr != nil {
+			return nil, newCorruptChunkError(header, fmt.Sprintf("diff range start: %v", startErr))
+		}
+		rangeLength, rangeLengthErr := s.ReadUint32()
+		if rangeLengthErr != nil {
+			return nil, newCorruptChunkError(header, fmt.Sprintf("diff range length: %v", rangeLengthErr))
+		}
+		if uint64(start)+uint64(rangeLength) > uint64(length) {
+			return nil, newCorruptChunkError(header, fmt.Sprintf("diff range %v+%v is outside of state with %v octets", start, rangeLength, length))
+		}
+		octets, octetsErr := s.ReadOctets(int(rangeLength))
+		if octetsErr != nil {
+			return nil, newCorruptChunkError(header, fmt.Sprintf("diff range octets: %v", octetsErr))
+		}
+		copy(next[start:], octets)
+	}
+
+	return next, nil
+}
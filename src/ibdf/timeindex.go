@@ -0,0 +1,85 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import "sort"
+
+type timeIndex struct {
+	infos []*HeaderInfo
+}
+
+func newTimeIndex(allInfos []*HeaderInfo, packetType PacketType) timeIndex {
+	var infos []*HeaderInfo
+	for _, info := range allInfos {
+		if info.packetType == packetType {
+			infos = append(infos, info)
+		}
+	}
+	sort.SliceStable(infos, func(a, b int) bool {
+		return infos[a].timestamp < infos[b].timestamp
+	})
+	return timeIndex{infos: infos}
+}
+
+// firstAfter returns the position of the first info with a timestamp greater than the given timestamp.
+func (t timeIndex) firstAfter(timestamp int64) int {
+	return sort.Search(len(t.infos), func(i int) bool {
+		return t.infos[i].timestamp > timestamp
+	})
+}
+
+// firstAtOrAfter returns the position of the first info with a timestamp equal to or greater than the given timestamp.
+func (t timeIndex) firstAtOrAfter(timestamp int64) int {
+	return sort.Search(len(t.infos), func(i int) bool {
+		return t.infos[i].timestamp >= timestamp
+	})
+}
+
+func (t timeIndex) lastBeforeOrAt(timestamp int64) *HeaderInfo {
+	pos := t.firstAfter(timestamp)
+	if pos == 0 {
+		return nil
+	}
+	return t.infos[pos-1]
+}
+
+func (t timeIndex) firstAtOrAfterInfo(timestamp int64) *HeaderInfo {
+	pos := t.firstAtOrAfter(timestamp)
+	if pos == len(t.infos) {
+		return nil
+	}
+	return t.infos[pos]
+}
+
+func (t timeIndex) inRange(startTimestamp int64, endTimestamp int64) []*HeaderInfo {
+	start := t.firstAtOrAfter(startTimestamp)
+	end := t.firstAtOrAfter(endTimestamp)
+	if end <= start {
+		return nil
+	}
+	return t.infos[start:end:end]
+}
@@ -0,0 +1,123 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/piot/brook-go/src/instream"
+	"github.com/piot/piff-go/src/piff"
+)
+
+type CorruptChunk struct {
+	PacketIndex PacketIndex
+	TypeID      string
+	// Offset is the position of the chunk in the file
+	Offset int64
+	Err    error
+}
+
+func (c CorruptChunk) String() string {
+	return fmt.Sprintf("chunk %v (%v) at offset %v: %v", c.PacketIndex, c.TypeID, c.Offset, c.Err)
+}
+
+func (c *InPacketFile) verifyChunk(packetIndex PacketIndex, typeID string) error {
+	header, payload, readErr := c.findChunk(packetIndex)
+	if readErr != nil {
+		return readErr
+	}
+	switch uncompressedTypeID(typeID) {
+	case "pac1":
+		_, headerErr := readHeader(instream.New(payload), len(payload))
+		return headerErr
+	case "sch1":
+		return nil
+	case "pkt1", "pkt2":
+		_, _, _, _, octets, packetErr := deserializeConnectionPacketFromPiffPayload(header, payload)
+		if packetErr != nil {
+			return packetErr
+		}
+		_, decompressErr := decompressOctets(header, octets)
+		return decompressErr
+	case "sta1":
+		_, _, octets, stateErr := deserializeStatePacketFromPiffPayload(header, payload)
+		if stateErr != nil {
+			return stateErr
+		}
+		_, decompressErr := decompressOctets(header, octets)
+		return decompressErr
+	case "std1":
+		_, _, _, diff, deltaErr := deserializeStateDeltaFromPiffPayload(header, payload)
+		if deltaErr != nil {
+			return deltaErr
+		}
+		_, decompressErr := decompressOctets(header, diff)
+		return decompressErr
+	case "con1":
+		_, _, _, eventErr := deserializeConnectionEvent(header, payload)
+		return eventErr
+	case "ann1":
+		_, _, _, annotationErr := deserializeAnnotationFromPiffPayload(header, payload)
+		return annotationErr
+	case "clk1":
+		_, _, clockErr := deserializeClockSync(header, payload)
+		return clockErr
+	case "idx1":
+		_, indexErr := deserializeIndex(header, payload)
+		return indexErr
+	default:
+		return fmt.Errorf("unknown type id %s", typeID)
+	}
+}
+
+// Verify reads every chunk in the file and returns the chunks that are corrupt. The returned error is only set
+// if the file can not be verified at all, e.g. if the piff structure or the file header can not be read.
+func Verify(readSeeker io.ReadSeeker) ([]CorruptChunk, error) {
+	inFile, err := piff.NewInSeeker(readSeeker)
+	if err != nil {
+		return nil, err
+	}
+	c := &InPacketFile{inFile: inFile}
+	var headerErr error
+	c.header, headerErr = c.readHeader(inFile)
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	var corruptChunks []CorruptChunk
+	offsets := chunkOffsets(inFile.AllHeaders())
+	for packetIndex, seekHeader := range inFile.AllHeaders() {
+		typeID := seekHeader.Header().TypeIDString()
+		verifyErr := c.verifyChunk(PacketIndex(packetIndex), typeID)
+		if verifyErr == nil {
+			continue
+		}
+		corruptChunks = append(corruptChunks, CorruptChunk{PacketIndex: PacketIndex(packetIndex), TypeID: typeID, Offset: offsets[packetIndex], Err: verifyErr})
+	}
+
+	return corruptChunks, nil
+}
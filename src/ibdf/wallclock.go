@@ -0,0 +1,63 @@
+/*
+
+MIT License
+
+Copyright (c) 2019 Peter Bjorklund
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package ibdf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type clockSync struct {
+	monotonicTimeMs int64
+	wallClock       time.Time
+}
+
+type wallClockAnchors struct {
+	syncs []clockSync
+}
+
+func (w wallClockAnchors) toWallClock(monotonicTimeMs int64) (time.Time, error) {
+	if len(w.syncs) == 0 {
+		return time.Time{}, fmt.Errorf("no wall clock sync found")
+	}
+	pos := sort.Search(len(w.syncs), func(i int) bool {
+		return w.syncs[i].monotonicTimeMs > monotonicTimeMs
+	})
+	if pos > 0 {
+		pos--
+	}
+	anchor := w.syncs[pos]
+	return anchor.wallClock.Add(time.Duration(monotonicTimeMs-anchor.monotonicTimeMs) * time.Millisecond), nil
+}
+
+func (w wallClockAnchors) startTime() (time.Time, error) {
+	if len(w.syncs) == 0 {
+		return time.Time{}, fmt.Errorf("no wall clock sync found")
+	}
+	return w.syncs[0].wallClock, nil
+}